@@ -17,3 +17,21 @@ const (
 	CmdSubscribe   = "SUBSCRIBE"
 	CmdUnsubscribe = "UNSUBSCRIBE"
 )
+
+var commands = map[string]bool{
+	CmdAbort:       true,
+	CmdAck:         true,
+	CmdBegin:       true,
+	CmdCommit:      true,
+	CmdConnect:     true,
+	CmdConnected:   true,
+	CmdDisconnect:  true,
+	CmdError:       true,
+	CmdMessage:     true,
+	CmdNack:        true,
+	CmdReceipt:     true,
+	CmdSend:        true,
+	CmdStomp:       true,
+	CmdSubscribe:   true,
+	CmdUnsubscribe: true,
+}
@@ -1,5 +1,9 @@
 package frame
 
+import (
+	"strconv"
+)
+
 type ParsingError struct {
 	msg string
 }
@@ -7,3 +11,48 @@ type ParsingError struct {
 func (err ParsingError) Error() string {
 	return err.msg
 }
+
+// Command line contain unknown command
+type BadCommandError struct {
+	Command string
+}
+
+func (err BadCommandError) Error() string {
+	return "Unknown command: " + err.Command
+}
+
+// Frame exceed ReaderOptions.MaxFrameSize
+type FrameTooLargeError struct {
+	Limit int
+}
+
+func (err FrameTooLargeError) Error() string {
+	return "Frame size exceed limit of " + strconv.Itoa(err.Limit) + " bytes"
+}
+
+// Frame exceed ReaderOptions.MaxHeaderCount
+type TooManyHeadersError struct {
+	Limit int
+}
+
+func (err TooManyHeadersError) Error() string {
+	return "Number of headers exceed limit of " + strconv.Itoa(err.Limit)
+}
+
+// Command or header line exceed ReaderOptions.MaxHeaderLine
+type HeaderTooLongError struct {
+	Limit int
+}
+
+func (err HeaderTooLongError) Error() string {
+	return "Header line exceed limit of " + strconv.Itoa(err.Limit) + " bytes"
+}
+
+// Frame body exceed ReaderOptions.MaxBodySize
+type BodyTooLargeError struct {
+	Limit int
+}
+
+func (err BodyTooLargeError) Error() string {
+	return "Body size exceed limit of " + strconv.Itoa(err.Limit) + " bytes"
+}
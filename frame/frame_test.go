@@ -20,7 +20,7 @@ func BenchmarkParseHeader(b *testing.B) {
 		fr := New()
 		fr.Command = CmdMessage
 		for _, h := range binHeaders {
-			fr.Header.Parse(h)
+			fr.Header.Parse(h, V12)
 		}
 	}
 }
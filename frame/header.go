@@ -27,13 +27,43 @@ const (
 	HdrVersion       = "version"
 )
 
-func Encode(value string, dest *[]byte) {
+// headers, specific to this server
+const (
+	HdrClientId            = "client-id"            // CONNECT, identify owner of durable subscriptions
+	HdrConsumerPriority    = "consumer-priority"    // SUBSCRIBE
+	HdrConsumerWeight      = "consumer-weight"      // SUBSCRIBE
+	HdrDelay               = "delay"                // SEND, milliseconds to delivery, replaced by deliver-at
+	HdrDeliverAt           = "deliver-at"           // SEND, MESSAGE, milliseconds since epoch, delivery to queue is postponed till then
+	HdrExclusive           = "exclusive"            // SUBSCRIBE, "true" for active/standby queue consumer
+	HdrExpires             = "expires"              // SEND, MESSAGE, milliseconds since epoch, 0 means never
+	HdrGroup               = "group"                // SEND, MESSAGE, messages of group are delivered to one queue subscription
+	HdrOriginalDestination = "original-destination" // MESSAGE moved to dead letter queue
+	HdrPersistent          = "persistent"           // SEND, "true" to save message in store of server
+	HdrPriority            = "priority"             // SEND, MESSAGE, 0-9, higher is delivered first
+	HdrPrefetchCount       = "prefetch-count"       // SUBSCRIBE
+	HdrRedeliveryCount     = "redelivery-count"     // MESSAGE
+	HdrReplyTo             = "reply-to"             // SEND, MESSAGE, destination for reply
+	HdrSelector            = "selector"             // SUBSCRIBE, SQL-like condition on message headers
+	HdrSubscriptionName    = "subscription-name"    // SUBSCRIBE, UNSUBSCRIBE of durable topic subscription
+	HdrTTL                 = "ttl"                  // SEND, milliseconds to expiration, replaced by expires
+)
+
+// Encode escape header name or value according to rules of given protocol version
+func Encode(value string, dest *[]byte, version string) {
+	if version == V10 {
+		*dest = append(*dest, value...)
+		return
+	}
 	for _, c := range []byte(value) {
 		switch c {
 		case '\\':
 			*dest = append(*dest, '\\', '\\')
 		case '\r':
-			*dest = append(*dest, '\\', 'r')
+			if version == V11 {
+				*dest = append(*dest, c)
+			} else {
+				*dest = append(*dest, '\\', 'r')
+			}
 		case '\n':
 			*dest = append(*dest, '\\', 'n')
 		case ':':
@@ -44,78 +74,157 @@ func Encode(value string, dest *[]byte) {
 	}
 }
 
-func Decode(value []byte) (string, error) {
-	dest := make([]byte, 0, len(value)+8)
-	i := 0
-	for i < len(value)-1 {
+// Decode unescape header name or value according to rules of given protocol version
+func Decode(value []byte, version string) (string, error) {
+	if version == V10 || bytes.IndexByte(value, '\\') < 0 {
+		return string(value), nil
+	}
+	dest := make([]byte, 0, len(value))
+	for i := 0; i < len(value); i++ {
 		c := value[i]
-		if c == '\\' {
-			switch value[i+1] {
-			case '\\':
-				dest = append(dest, '\\')
-			case 'r':
-				dest = append(dest, '\r')
-			case 'n':
-				dest = append(dest, '\n')
-			case 'c':
-				dest = append(dest, 'c')
-			default:
-				return "", ParsingError{msg: fmt.Sprintf("Bad escape sequence \\%c in header %s", value[i+1], string(value))}
-			}
-			i += 2
-		} else {
+		if c != '\\' {
 			dest = append(dest, c)
-			i += 1
+			continue
+		}
+		i++
+		if i == len(value) {
+			return "", ParsingError{msg: "Bad escape sequence at the end of header " + string(value)}
+		}
+		switch value[i] {
+		case '\\':
+			dest = append(dest, '\\')
+		case 'r':
+			if version == V11 {
+				return "", ParsingError{msg: "Bad escape sequence \\r in header " + string(value)}
+			}
+			dest = append(dest, '\r')
+		case 'n':
+			dest = append(dest, '\n')
+		case 'c':
+			dest = append(dest, ':')
+		default:
+			return "", ParsingError{msg: fmt.Sprintf("Bad escape sequence \\%c in header %s", value[i], string(value))}
 		}
 	}
-	dest = append(dest, value[i])
 	return string(dest), nil
 }
 
+type headerField struct {
+	name  string
+	value string
+}
+
+// Header keep headers in order of appearance, including repeated ones.
+// As required by STOMP spec, only the first occurrence of repeated header is significant
 type Header struct {
-	headers map[string]string
+	fields []headerField
 }
 
 func NewHeader() *Header {
 	return &Header{
-		headers: make(map[string]string, 8),
+		fields: make([]headerField, 0, 8),
 	}
 }
 
+// Get return value of the first occurrence of header
 func (h *Header) Get(name string) (value string, ok bool) {
-	value, ok = h.headers[name]
-	return
+	for _, f := range h.fields {
+		if f.name == name {
+			return f.value, true
+		}
+	}
+	return "", false
+}
+
+// GetAll return values of all occurrences of header, in order of appearance
+func (h *Header) GetAll(name string) []string {
+	var res []string
+	for _, f := range h.fields {
+		if f.name == name {
+			res = append(res, f.value)
+		}
+	}
+	return res
 }
 
+// Set replace all occurrences of header with single value,
+// keeping position of the first one
 func (h *Header) Set(name, value string) {
-	h.headers[name] = value
+	for i, f := range h.fields {
+		if f.name == name {
+			h.fields[i].value = value
+			h.delFrom(name, i+1)
+			return
+		}
+	}
+	h.fields = append(h.fields, headerField{name: name, value: value})
+}
+
+// Add append header, keeping existing occurrences
+func (h *Header) Add(name, value string) {
+	h.fields = append(h.fields, headerField{name: name, value: value})
+}
+
+// Del remove all occurrences of header
+func (h *Header) Del(name string) {
+	h.delFrom(name, 0)
+}
+
+func (h *Header) delFrom(name string, start int) {
+	res := h.fields[:start]
+	for _, f := range h.fields[start:] {
+		if f.name != name {
+			res = append(res, f)
+		}
+	}
+	h.fields = res
 }
 
+// Len return number of headers, including repeated ones
+func (h *Header) Len() int {
+	return len(h.fields)
+}
+
+// Range call f for every header in order of appearance until f return false
+func (h *Header) Range(f func(name, value string) bool) {
+	for _, fld := range h.fields {
+		if !f(fld.name, fld.value) {
+			return
+		}
+	}
+}
+
+// Update replace headers with all occurrences of the same headers from src
 func (h *Header) Update(src Header) {
-	for k, v := range src.headers {
-		h.headers[k] = v
+	for _, f := range src.fields {
+		h.Del(f.name)
 	}
+	h.fields = append(h.fields, src.fields...)
 }
 
-func (h *Header) Parse(buf []byte) error {
+func (h *Header) Parse(buf []byte, version string) error {
 	p := bytes.IndexByte(buf, ':')
 	if p < 0 {
 		return ParsingError{msg: "Missing semicolon in header " + string(buf)}
 	}
-	val, err := Decode(buf[p+1:])
+	name, err := Decode(buf[:p], version)
+	if err != nil {
+		return err
+	}
+	val, err := Decode(buf[p+1:], version)
 	if err != nil {
 		return err
 	}
-	h.Set(string(buf[:p]), val)
+	h.Add(name, val)
 	return nil
 }
 
-func (h *Header) Write(b *[]byte) {
+func (h *Header) Write(b *[]byte, version string) {
 	buf := *b
-	for k, v := range h.headers {
-		buf = append(buf, []byte(k)...)
+	for _, f := range h.fields {
+		Encode(f.name, &buf, version)
 		buf = append(buf, ':')
-		Encode(v, &buf)
+		Encode(f.value, &buf, version)
 		buf = append(buf, '\n')
 	}
 	*b = buf
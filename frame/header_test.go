@@ -0,0 +1,72 @@
+package frame
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestHeaderRepeated(t *testing.T) {
+	h := NewHeader()
+	h.Add("foo", "1")
+	h.Add("bar", "2")
+	h.Add("foo", "3")
+	assert.Equal(t, 3, h.Len())
+	foo, ok := h.Get("foo")
+	assert.True(t, ok)
+	assert.Equal(t, "1", foo, "first occurrence must win")
+	assert.Equal(t, []string{"1", "3"}, h.GetAll("foo"))
+
+	h.Set("foo", "4")
+	assert.Equal(t, 2, h.Len())
+	assert.Equal(t, []string{"4"}, h.GetAll("foo"))
+
+	h.Del("foo")
+	_, ok = h.Get("foo")
+	assert.False(t, ok)
+	assert.Equal(t, 1, h.Len())
+}
+
+func TestHeaderOrder(t *testing.T) {
+	h := NewHeader()
+	names := []string{"z", "a", "m", "a", "b"}
+	for i, name := range names {
+		h.Add(name, string(rune('0'+i)))
+	}
+	var res []string
+	h.Range(func(name, value string) bool {
+		res = append(res, name+value)
+		return true
+	})
+	assert.Equal(t, []string{"z0", "a1", "m2", "a3", "b4"}, res)
+
+	var buf []byte
+	h.Write(&buf, V12)
+	assert.Equal(t, "z:0\na:1\nm:2\na:3\nb:4\n", string(buf))
+}
+
+func TestHeaderUpdate(t *testing.T) {
+	h := NewHeader()
+	h.Add("a", "1")
+	h.Add("b", "2")
+	src := NewHeader()
+	src.Add("b", "3")
+	src.Add("b", "4")
+	h.Update(*src)
+	assert.Equal(t, []string{"3", "4"}, h.GetAll("b"))
+	a, _ := h.Get("a")
+	assert.Equal(t, "1", a)
+}
+
+func TestReadRepeatedHeader(t *testing.T) {
+	msg := "MESSAGE\ndestination:/queue/1\nfoo:first\nfoo:second\n\n\x00"
+	fr, err := NewReader(bytes.NewReader([]byte(msg))).Read()
+	assert.NoError(t, err)
+	foo, _ := fr.Header.Get("foo")
+	assert.Equal(t, "first", foo)
+
+	var buf bytes.Buffer
+	err = NewWriter(&buf).Write(fr)
+	assert.NoError(t, err)
+	assert.Equal(t, msg, buf.String())
+}
@@ -2,46 +2,188 @@ package frame
 
 import (
 	"bufio"
+	"errors"
 	"io"
+	"strconv"
 )
 
+// Limits of incoming frames. Zero value of any field means no limit
+type ReaderOptions struct {
+	// size of the whole frame, including command, headers and body
+	MaxFrameSize int
+	// number of headers in frame
+	MaxHeaderCount int
+	// length of command or header line
+	MaxHeaderLine int
+	// size of frame body
+	MaxBodySize int
+}
+
+// limits, reasonable for server, accepting frames from untrusted clients
+var DefaultReaderOptions = ReaderOptions{
+	MaxFrameSize:   16 * 1024 * 1024,
+	MaxHeaderCount: 1000,
+	MaxHeaderLine:  8 * 1024,
+	MaxBodySize:    16 * 1024 * 1024,
+}
+
+var errLimit = errors.New("limit exceeded")
+
 type Reader struct {
-	reader *bufio.Reader
+	reader  *bufio.Reader
+	options ReaderOptions
+	line    []byte
+	// negotiated protocol version, define header escaping and line endings
+	Version string
 }
 
 func NewReader(reader io.Reader) *Reader {
+	return NewReaderOptions(reader, ReaderOptions{})
+}
+
+func NewReaderOptions(reader io.Reader, options ReaderOptions) *Reader {
 	return &Reader{
-		reader: bufio.NewReader(reader),
+		reader:  bufio.NewReader(reader),
+		options: options,
+		Version: V12,
+	}
+}
+
+// strip line terminator, which is LF or, since STOMP 1.2, CR LF
+func (r *Reader) trimEOL(line []byte) []byte {
+	line = line[:len(line)-1]
+	if r.Version == V12 && len(line) > 0 && line[len(line)-1] == '\r' {
+		line = line[:len(line)-1]
+	}
+	return line
+}
+
+// read bytes up to and including delim.
+// Negative limit means no limit.
+// Returned slice is valid until next read
+func (r *Reader) readUntil(delim byte, limit int) ([]byte, error) {
+	r.line = r.line[:0]
+	for {
+		chunk, err := r.reader.ReadSlice(delim)
+		if limit >= 0 && len(r.line)+len(chunk) > limit {
+			return nil, errLimit
+		}
+		if err == bufio.ErrBufferFull {
+			r.line = append(r.line, chunk...)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(r.line) == 0 {
+			return chunk, nil
+		}
+		r.line = append(r.line, chunk...)
+		return r.line, nil
 	}
 }
 
+// choose the most restrictive of given limit and the rest of frame size limit
+func (r *Reader) limit(size, limit int, limitErr error) (int, error) {
+	if limit == 0 {
+		limit = -1
+	}
+	if r.options.MaxFrameSize > 0 {
+		rest := r.options.MaxFrameSize - size
+		if limit < 0 || rest < limit {
+			return rest, FrameTooLargeError{Limit: r.options.MaxFrameSize}
+		}
+	}
+	return limit, limitErr
+}
+
+func (r *Reader) readLine(size int) ([]byte, error) {
+	limit, limitErr := r.limit(size, r.options.MaxHeaderLine, HeaderTooLongError{Limit: r.options.MaxHeaderLine})
+	line, err := r.readUntil('\n', limit)
+	if err == errLimit {
+		return nil, limitErr
+	}
+	return line, err
+}
+
 func (r *Reader) Read() (*Frame, error) {
 	fr := New()
-	// Command
-	cmd, err := r.reader.ReadSlice('\n')
-	if err != nil {
-		return nil, err
+	// Command, preceded by any number of heart-beats
+	var size int
+	for {
+		cmd, err := r.readLine(0)
+		if err != nil {
+			return nil, err
+		}
+		size = len(cmd)
+		fr.Command = string(r.trimEOL(cmd))
+		if fr.Command != "" {
+			break
+		}
 	}
-	fr.Command = string(cmd[:len(cmd)-1])
+	if !commands[fr.Command] {
+		return nil, BadCommandError{Command: fr.Command}
+	}
+	version := escapeVersion(fr.Command, r.Version)
 	// Headers
 	for {
-		h, err := r.reader.ReadSlice('\n')
+		h, err := r.readLine(size)
 		if err != nil {
 			return nil, err
 		}
-		if len(h) == 1 {
+		size += len(h)
+		h = r.trimEOL(h)
+		if len(h) == 0 {
 			// empty line - end of headers
 			break
 		}
-		err = fr.Header.Parse(h[:len(h)-1])
+		if r.options.MaxHeaderCount > 0 && fr.Header.Len() >= r.options.MaxHeaderCount {
+			return nil, TooManyHeadersError{Limit: r.options.MaxHeaderCount}
+		}
+		err = fr.Header.Parse(h, version)
 		if err != nil {
 			return nil, err
 		}
 	}
-	tmpBody, err := r.reader.ReadBytes(0)
+	// Body
+	if cl, ok := fr.Header.Get(HdrContentLength); ok {
+		bodySize, err := strconv.Atoi(cl)
+		if err != nil || bodySize < 0 {
+			return nil, ParsingError{msg: "Invalid content-length header " + cl}
+		}
+		if r.options.MaxBodySize > 0 && bodySize > r.options.MaxBodySize {
+			return nil, BodyTooLargeError{Limit: r.options.MaxBodySize}
+		}
+		if r.options.MaxFrameSize > 0 && size+bodySize+1 > r.options.MaxFrameSize {
+			return nil, FrameTooLargeError{Limit: r.options.MaxFrameSize}
+		}
+		fr.Body = make([]byte, bodySize)
+		_, err = io.ReadFull(r.reader, fr.Body)
+		if err != nil {
+			return nil, err
+		}
+		term, err := r.reader.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		if term != 0 {
+			return nil, ParsingError{msg: "Missing zero byte after body of content-length " + cl}
+		}
+		return fr, nil
+	}
+	bodyLimit := r.options.MaxBodySize
+	if bodyLimit > 0 {
+		// terminating zero byte
+		bodyLimit += 1
+	}
+	limit, limitErr := r.limit(size, bodyLimit, BodyTooLargeError{Limit: r.options.MaxBodySize})
+	tmpBody, err := r.readUntil(0, limit)
+	if err == errLimit {
+		return nil, limitErr
+	}
 	if err != nil {
 		return nil, err
 	}
-	fr.Body = tmpBody[:len(tmpBody)-1] // strip terminating zero byte
+	fr.Body = append([]byte(nil), tmpBody[:len(tmpBody)-1]...) // strip terminating zero byte
 	return fr, nil
 }
@@ -56,6 +56,81 @@ func TestReadManyFrames(t *testing.T) {
 	assert.Equal(t, []byte("msg body"), fr2.Body)
 }
 
+func TestReadHeartBeats(t *testing.T) {
+	msg := "\n\r\n\nSEND\ndestination:/queue/1\n\nmsg\x00\n\nACK\nid:1\n\n\x00"
+	reader := NewReader(bytes.NewReader([]byte(msg)))
+	fr1, err := reader.Read()
+	assert.NoError(t, err)
+	assert.Equal(t, CmdSend, fr1.Command)
+	fr2, err := reader.Read()
+	assert.NoError(t, err)
+	assert.Equal(t, CmdAck, fr2.Command)
+}
+
+func TestReadContentLength(t *testing.T) {
+	messages := []string{
+		"SEND\ndestination:/queue/1\ncontent-length:9\n\nmsg\x00\x01body\x00",
+		"SEND\ndestination:/queue/1\n\nnext\x00",
+	}
+	reader := NewReader(bytes.NewReader([]byte(strings.Join(messages, ""))))
+	fr1, err := reader.Read()
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("msg\x00\x01body"), fr1.Body)
+	fr2, err := reader.Read()
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("next"), fr2.Body)
+}
+
+func TestReadContentLengthErr(t *testing.T) {
+	for _, msg := range []string{
+		// body longer than content-length
+		"SEND\ndestination:/queue/1\ncontent-length:3\n\nmsg body\x00",
+		"SEND\ndestination:/queue/1\ncontent-length:abc\n\nmsg\x00",
+	} {
+		reader := NewReader(bytes.NewReader([]byte(msg)))
+		_, err := reader.Read()
+		assert.Error(t, err, "Expected error")
+	}
+}
+
+func TestReadLimits(t *testing.T) {
+	options := ReaderOptions{
+		MaxFrameSize:   64,
+		MaxHeaderCount: 2,
+		MaxHeaderLine:  32,
+		MaxBodySize:    16,
+	}
+	data := []struct {
+		msg string
+		err error
+	}{
+		{"SEND\ndestination:/queue/1\n\nmsg\x00", nil},
+		{"FOO\ndestination:/queue/1\n\nmsg\x00", BadCommandError{Command: "FOO"}},
+		{"SEND\na:1\nb:2\nc:3\n\nmsg\x00", TooManyHeadersError{Limit: 2}},
+		{"SEND\ndestination:/queue/12345678901234567890\n\nmsg\x00", HeaderTooLongError{Limit: 32}},
+		{"SEND\ndestination:/queue/1\n\n" + strings.Repeat("b", 17) + "\x00", BodyTooLargeError{Limit: 16}},
+		{"SEND\ncontent-length:17\n\n" + strings.Repeat("b", 17) + "\x00", BodyTooLargeError{Limit: 16}},
+		{"SEND\ndestination:/queue/1234567\nx-header:123456789012345\n\n" + strings.Repeat("b", 16) + "\x00", FrameTooLargeError{Limit: 64}},
+	}
+	for _, d := range data {
+		reader := NewReaderOptions(bytes.NewReader([]byte(d.msg)), options)
+		_, err := reader.Read()
+		assert.Equal(t, d.err, err, d.msg)
+	}
+}
+
+func TestReadLongLines(t *testing.T) {
+	// lines longer than internal buffer
+	value := strings.Repeat("v", 10000)
+	body := strings.Repeat("b", 10000)
+	msg := "SEND\nx-long:" + value + "\n\n" + body + "\x00"
+	fr, err := NewReader(bytes.NewReader([]byte(msg))).Read()
+	assert.NoError(t, err)
+	long, _ := fr.Header.Get("x-long")
+	assert.Equal(t, value, long)
+	assert.Equal(t, []byte(body), fr.Body)
+}
+
 type FuncReader func(dest []byte) (n int, err error)
 
 func (f FuncReader) Read(dest []byte) (n int, err error) {
@@ -65,7 +140,7 @@ func (f FuncReader) Read(dest []byte) (n int, err error) {
 var gfr *Frame
 
 func BenchmarkReader(b *testing.B) {
-	msg := []byte("SEND\ndestination:/queue/20161202\ncontent-length:9\n\nmsg body\x00")
+	msg := []byte("SEND\ndestination:/queue/20161202\ncontent-length:8\n\nmsg body\x00")
 	buf := msg
 	// io.Reader, that repeat the same message
 	src := FuncReader(func(dest []byte) (int, error) {
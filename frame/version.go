@@ -0,0 +1,41 @@
+package frame
+
+import (
+	"strings"
+)
+
+const (
+	V10 = "1.0"
+	V11 = "1.1"
+	V12 = "1.2"
+)
+
+// protocol versions supported by this package, in order of preference
+var SupportedVersions = []string{V12, V11, V10}
+
+// NegotiateVersion select the highest supported version from
+// the accept-version header of CONNECT frame.
+// Missing header means that client support only STOMP 1.0
+func NegotiateVersion(acceptVersion string) (version string, ok bool) {
+	if acceptVersion == "" {
+		return V10, true
+	}
+	accepted := strings.Split(acceptVersion, ",")
+	for _, v := range SupportedVersions {
+		for _, a := range accepted {
+			if strings.TrimSpace(a) == v {
+				return v, true
+			}
+		}
+	}
+	return "", false
+}
+
+// headers of CONNECT and CONNECTED frames are never escaped
+func escapeVersion(command, version string) string {
+	switch command {
+	case CmdConnect, CmdStomp, CmdConnected:
+		return V10
+	}
+	return version
+}
@@ -0,0 +1,77 @@
+package frame
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestNegotiateVersion(t *testing.T) {
+	data := []struct {
+		accept   string
+		expected string
+		ok       bool
+	}{
+		{"", V10, true},
+		{"1.0", V10, true},
+		{"1.0,1.1", V11, true},
+		{"1.1,1.2,1.0", V12, true},
+		{"2.0", "", false},
+	}
+	for _, d := range data {
+		version, ok := NegotiateVersion(d.accept)
+		assert.Equal(t, d.ok, ok, d.accept)
+		assert.Equal(t, d.expected, version, d.accept)
+	}
+}
+
+func TestEncodeDecodeVersions(t *testing.T) {
+	value := "a:b\\c\r\nd"
+	data := []struct {
+		version string
+		encoded string
+	}{
+		{V10, "a:b\\c\r\nd"},
+		{V11, "a\\cb\\\\c\r\\nd"},
+		{V12, "a\\cb\\\\c\\r\\nd"},
+	}
+	for _, d := range data {
+		var buf []byte
+		Encode(value, &buf, d.version)
+		assert.Equal(t, d.encoded, string(buf), d.version)
+		decoded, err := Decode(buf, d.version)
+		assert.NoError(t, err)
+		assert.Equal(t, value, decoded, d.version)
+	}
+	// \r escape is not defined in STOMP 1.1
+	_, err := Decode([]byte("a\\rb"), V11)
+	assert.Error(t, err)
+	_, err = Decode([]byte("ab\\"), V12)
+	assert.Error(t, err)
+}
+
+func TestReadVersions(t *testing.T) {
+	msg := "SEND\r\ndestination:/queue/a\\cb\r\n\r\nbody\x00"
+	reader := NewReader(bytes.NewReader([]byte(msg)))
+	fr, err := reader.Read()
+	assert.NoError(t, err)
+	assert.Equal(t, CmdSend, fr.Command)
+	dest, _ := fr.Header.Get(HdrDestination)
+	assert.Equal(t, "/queue/a:b", dest)
+
+	msg = "SEND\ndestination:/queue/a\\cb\n\nbody\x00"
+	reader = NewReader(bytes.NewReader([]byte(msg)))
+	reader.Version = V10
+	fr, err = reader.Read()
+	assert.NoError(t, err)
+	dest, _ = fr.Header.Get(HdrDestination)
+	assert.Equal(t, "/queue/a\\cb", dest)
+
+	// CONNECT frame is never escaped
+	msg = "CONNECT\nlogin:a\\b\n\n\x00"
+	reader = NewReader(bytes.NewReader([]byte(msg)))
+	fr, err = reader.Read()
+	assert.NoError(t, err)
+	login, _ := fr.Header.Get(HdrLogin)
+	assert.Equal(t, "a\\b", login)
+}
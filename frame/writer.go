@@ -3,6 +3,7 @@ package frame
 import (
 	"bufio"
 	"io"
+	"strconv"
 )
 
 type FrameWriter interface {
@@ -12,12 +13,18 @@ type FrameWriter interface {
 type Writer struct {
 	w   *bufio.Writer
 	buf []byte
+	// if set, add content-length header to frames, which don't have one,
+	// so that bodies with zero bytes can be read back by Reader
+	AutoContentLength bool
+	// negotiated protocol version, define header escaping
+	Version string
 }
 
 func NewWriter(w io.Writer) *Writer {
 	wr := &Writer{
-		w:   bufio.NewWriter(w),
-		buf: make([]byte, 240),
+		w:       bufio.NewWriter(w),
+		buf:     make([]byte, 240),
+		Version: V12,
 	}
 	return wr
 }
@@ -30,7 +37,8 @@ func (w *Writer) Write2(fr *Frame) error {
 		return err
 	}
 	wb('\n')
-	fr.Header.Write(&w.buf)
+	fr.Header.Write(&w.buf, escapeVersion(fr.Command, w.Version))
+	w.addContentLength(fr, &w.buf)
 	wr(w.buf)
 	if err != nil {
 		return err
@@ -49,7 +57,8 @@ func (w *Writer) Write(fr *Frame) error {
 	b := w.buf[:0]
 	b = append(b, []byte(fr.Command)...)
 	b = append(b, '\n')
-	fr.Header.Write(&b)
+	fr.Header.Write(&b, escapeVersion(fr.Command, w.Version))
+	w.addContentLength(fr, &b)
 	b = append(b, '\n')
 	_, err := w.w.Write(b)
 	if err != nil {
@@ -59,8 +68,32 @@ func (w *Writer) Write(fr *Frame) error {
 	if err != nil {
 		return err
 	}
-	w.w.Write([]byte{0})
-	w.w.Flush()
 	w.buf = b
-	return nil
+	err = w.w.WriteByte(0)
+	if err != nil {
+		return err
+	}
+	return w.w.Flush()
+}
+
+// WriteHeartBeat write single EOL, which keep connection alive between frames
+func (w *Writer) WriteHeartBeat() error {
+	err := w.w.WriteByte('\n')
+	if err != nil {
+		return err
+	}
+	return w.w.Flush()
+}
+
+func (w *Writer) addContentLength(fr *Frame, b *[]byte) {
+	if !w.AutoContentLength {
+		return
+	}
+	if _, ok := fr.Header.Get(HdrContentLength); ok {
+		return
+	}
+	buf := append(*b, HdrContentLength...)
+	buf = append(buf, ':')
+	buf = strconv.AppendInt(buf, int64(len(fr.Body)), 10)
+	*b = append(buf, '\n')
 }
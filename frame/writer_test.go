@@ -48,6 +48,20 @@ func TestWriter(t *testing.T) {
 	}
 }
 
+func TestWriterContentLength(t *testing.T) {
+	var buf bytes.Buffer
+	writer := NewWriter(&buf)
+	writer.AutoContentLength = true
+	fr := makeFrame(&TestData{cmd: CmdMessage, body: "bin\x00body"})
+	err := writer.Write(fr)
+	assert.NoError(t, err)
+	assert.Equal(t, "MESSAGE\ncontent-length:8\n\nbin\x00body\x00", string(buf.Bytes()))
+
+	res, err := NewReader(&buf).Read()
+	assert.NoError(t, err)
+	assert.Equal(t, fr.Body, res.Body)
+}
+
 type NullWriter struct{}
 
 func (n *NullWriter) Write(p []byte) (int, error) {
@@ -0,0 +1,155 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+var ErrAccessDenied = errors.New("Access denied")
+
+type Permission int
+
+const (
+	PermRead Permission = 1 << iota
+	PermWrite
+	// admin permission imply both read and write
+	PermAdmin
+)
+
+var permissionNames = map[string]Permission{
+	"read":  PermRead,
+	"write": PermWrite,
+	"admin": PermAdmin,
+}
+
+type Authorizer interface {
+	// Authorize return error if principal don't have permission on destination
+	Authorize(principal *Principal, perm Permission, destination string) error
+}
+
+// Rule grant permissions on destinations, matching Pattern,
+// to listed users and members of listed groups.
+// Pattern has the same syntax as wildcard destination: "*" match any single
+// segment of destination, and trailing ">" match the rest of destination.
+// Wildcard destination match pattern only if pattern match every destination,
+// matched by wildcard, so that wildcard subscription doesn't get messages
+// of destinations, which client can't subscribe to directly
+type Rule struct {
+	Pattern     string
+	Users       []string
+	Groups      []string
+	Permissions Permission
+}
+
+func (r *Rule) appliesTo(principal *Principal) bool {
+	for _, u := range r.Users {
+		if u == "*" || u == principal.Name {
+			return true
+		}
+	}
+	for _, g := range r.Groups {
+		for _, pg := range principal.Groups {
+			if g == pg {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func matchDestination(pattern, destination string) bool {
+	return matchTokens(tokenizeDestination(pattern), tokenizeDestination(destination))
+}
+
+func matchTokens(pattern, destination []string) bool {
+	for i, p := range pattern {
+		if p == ">" && i == len(pattern)-1 {
+			return i < len(destination)
+		}
+		if i == len(destination) {
+			return false
+		}
+		d := destination[i]
+		if p == "*" {
+			// wildcard "*" of destination is covered too, but not ">"
+			if isSeparator(d) || d == ">" {
+				return false
+			}
+		} else if p != d {
+			return false
+		}
+	}
+	return len(pattern) == len(destination)
+}
+
+// RuleAuthorizer deny everything, not explicitly granted by one of the rules
+type RuleAuthorizer struct {
+	Rules []Rule
+}
+
+func (a *RuleAuthorizer) Authorize(principal *Principal, perm Permission, destination string) error {
+	for i := range a.Rules {
+		rule := &a.Rules[i]
+		if rule.Permissions&(perm|PermAdmin) != 0 && rule.appliesTo(principal) && matchDestination(rule.Pattern, destination) {
+			return nil
+		}
+	}
+	return ErrAccessDenied
+}
+
+// NewFileAuthorizer load rules from file with lines
+//
+//	permissions pattern subject...
+//
+// where permissions is comma separated list of read, write and admin,
+// and subject is user:<login>, group:<name> or * for any client.
+// Empty lines and lines starting with # are ignored.
+func NewFileAuthorizer(path string) (*RuleAuthorizer, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	auth := &RuleAuthorizer{}
+	scanner := bufio.NewScanner(f)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 3 {
+			return nil, fmt.Errorf("%s:%d: expected permissions, pattern and subjects", path, lineNo)
+		}
+		rule := Rule{Pattern: fields[1]}
+		for _, name := range strings.Split(fields[0], ",") {
+			perm, ok := permissionNames[name]
+			if !ok {
+				return nil, fmt.Errorf("%s:%d: unknown permission %s", path, lineNo, name)
+			}
+			rule.Permissions |= perm
+		}
+		for _, subject := range fields[2:] {
+			switch {
+			case subject == "*":
+				rule.Users = append(rule.Users, subject)
+			case strings.HasPrefix(subject, "user:"):
+				rule.Users = append(rule.Users, subject[len("user:"):])
+			case strings.HasPrefix(subject, "group:"):
+				rule.Groups = append(rule.Groups, subject[len("group:"):])
+			default:
+				return nil, fmt.Errorf("%s:%d: bad subject %s", path, lineNo, subject)
+			}
+		}
+		auth.Rules = append(auth.Rules, rule)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return auth, nil
+}
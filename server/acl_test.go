@@ -0,0 +1,96 @@
+package server
+
+import (
+	"github.com/galtsev/stomp/frame"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestMatchDestination(t *testing.T) {
+	data := []struct {
+		pattern     string
+		destination string
+		match       bool
+	}{
+		{"/queue/orders", "/queue/orders", true},
+		{"/queue/orders", "/queue/orders2", false},
+		{"/queue/>", "/queue/orders", true},
+		{"/queue/>", "/topic/orders", false},
+		{"/topic/prices.*.EUR", "/topic/prices.AAPL.EUR", true},
+		{"/topic/prices.*.EUR", "/topic/prices.AAPL.USD", false},
+		{"/topic/prices.*.EUR", "/topic/prices.A.B.EUR", false},
+		{"/queue/*", "/queue/a", true},
+		{"/queue/*", "/queue/a/b", false},
+		{">", "/anything", true},
+		{"/queue/a*", "/queue/ab", false},
+		// wildcard destination must be covered by pattern as a whole
+		{"/topic/*", "/topic/>", false},
+		{"/topic/*", "/topic/*", true},
+		{"/topic/prices.>", "/topic/prices.*.EUR", true},
+		{"/topic/prices.*.EUR", "/topic/prices.*.*", false},
+		{"/topic/>", "/topic/>", true},
+	}
+	for _, d := range data {
+		assert.Equal(t, d.match, matchDestination(d.pattern, d.destination), d.pattern+" "+d.destination)
+	}
+}
+
+func TestFileAuthorizer(t *testing.T) {
+	path := makeTempFile(t,
+		"# producers",
+		"write /queue/orders.> user:bob group:producers",
+		"read /topic/prices.* *",
+		"admin > group:admins",
+	)
+	defer os.Remove(path)
+	auth, err := NewFileAuthorizer(path)
+	assert.NoError(t, err)
+
+	bob := &Principal{Name: "bob"}
+	eve := &Principal{Name: "eve", Groups: []string{"producers"}}
+	root := &Principal{Name: "root", Groups: []string{"admins"}}
+	assert.NoError(t, auth.Authorize(bob, PermWrite, "/queue/orders.new"))
+	assert.Equal(t, ErrAccessDenied, auth.Authorize(bob, PermRead, "/queue/orders.new"))
+	assert.NoError(t, auth.Authorize(eve, PermWrite, "/queue/orders.new"))
+	assert.NoError(t, auth.Authorize(eve, PermRead, "/topic/prices.EUR"))
+	assert.Equal(t, ErrAccessDenied, auth.Authorize(eve, PermWrite, "/topic/prices.EUR"))
+	assert.NoError(t, auth.Authorize(root, PermRead, "/queue/secret"))
+	assert.NoError(t, auth.Authorize(root, PermWrite, "/queue/secret"))
+
+	badPath := makeTempFile(t, "execute /queue/1 *")
+	defer os.Remove(badPath)
+	_, err = NewFileAuthorizer(badPath)
+	assert.Error(t, err)
+}
+
+func TestHandlerAuthorization(t *testing.T) {
+	server := NewServer()
+	server.Authorizer = &RuleAuthorizer{
+		Rules: []Rule{{Pattern: "/queue/public", Users: []string{"*"}, Permissions: PermRead | PermWrite}},
+	}
+	handler := NewHandler(server, nil, nil)
+	handler.Handle(*makeSubscriptionFrame("sid1", "/queue/public"))
+
+	fr := makeSendFrame("/queue/private", "body")
+	fr.Header.Set(frame.HdrReceipt, "r1")
+	handled := make(chan struct{})
+	go func() {
+		handler.Handle(*fr)
+		close(handled)
+	}()
+	select {
+	case outFr := <-handler.outChan:
+		assert.Equal(t, frame.CmdError, outFr.Command)
+		receiptId, _ := outFr.Header.Get(frame.HdrReceiptId)
+		assert.Equal(t, "r1", receiptId)
+	case <-time.NewTimer(time.Millisecond * 10).C:
+		t.Fatal("Timeout getting ERROR frame")
+	}
+	<-handled
+	server.dispLock.RLock()
+	_, ok := server.Dispatchers["/queue/private"]
+	server.dispLock.RUnlock()
+	assert.False(t, ok, "Dispatcher must not be created for denied destination")
+}
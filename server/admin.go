@@ -0,0 +1,115 @@
+package server
+
+import (
+	"encoding/json"
+	"github.com/galtsev/stomp/frame"
+	"net/http"
+)
+
+// AdminHandler serve HTTP interface for management of scheduled messages:
+//
+//	GET /scheduled?destination=/queue/name           list scheduled messages as JSON
+//	DELETE /scheduled?destination=/queue/name&id=ID  cancel scheduled message
+//
+// When server has Authenticator, requests must use basic authentication
+// with login and passcode of STOMP client, which has admin permission on destination
+type AdminHandler struct {
+	Server *Server
+	mux    *http.ServeMux
+}
+
+func NewAdminHandler(server *Server) *AdminHandler {
+	admin := &AdminHandler{
+		Server: server,
+		mux:    http.NewServeMux(),
+	}
+	admin.mux.HandleFunc("/scheduled", admin.scheduled)
+	return admin
+}
+
+type scheduledMessage struct {
+	MessageId string            `json:"message-id"`
+	DeliverAt int64             `json:"deliver-at"`
+	Headers   map[string]string `json:"headers"`
+	Size      int               `json:"size"`
+}
+
+func (a *AdminHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	a.mux.ServeHTTP(w, r)
+}
+
+// check credentials and permission of request, write error response if it is denied
+func (a *AdminHandler) authorize(w http.ResponseWriter, r *http.Request, destination string) bool {
+	principal := Anonymous
+	if a.Server.Authenticator != nil {
+		login, passcode, ok := r.BasicAuth()
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Basic realm="stomp"`)
+			http.Error(w, ErrAuthenticationFailed.Error(), http.StatusUnauthorized)
+			return false
+		}
+		header := frame.NewHeader()
+		header.Set(frame.HdrLogin, login)
+		header.Set(frame.HdrPasscode, passcode)
+		var err error
+		principal, err = a.Server.Authenticator.Authenticate(*header)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return false
+		}
+	}
+	if a.Server.Authorizer != nil {
+		if err := a.Server.Authorizer.Authorize(principal, PermAdmin, destination); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return false
+		}
+	}
+	return true
+}
+
+func (a *AdminHandler) scheduled(w http.ResponseWriter, r *http.Request) {
+	destination := r.URL.Query().Get("destination")
+	if destination == "" {
+		http.Error(w, "Missing destination", http.StatusBadRequest)
+		return
+	}
+	if !a.authorize(w, r, destination) {
+		return
+	}
+	a.Server.dispLock.RLock()
+	queue, ok := a.Server.Dispatchers[destination].(*Queue)
+	a.Server.dispLock.RUnlock()
+	if !ok {
+		http.Error(w, "Unknown queue "+destination, http.StatusNotFound)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		messages := []scheduledMessage{}
+		for _, fr := range queue.Scheduled() {
+			msg := scheduledMessage{
+				DeliverAt: deliveryTime(fr),
+				Headers:   make(map[string]string),
+				Size:      len(fr.Body),
+			}
+			msg.MessageId, _ = fr.Header.Get(frame.HdrMessageId)
+			fr.Header.Range(func(name, value string) bool {
+				if _, ok := msg.Headers[name]; !ok {
+					msg.Headers[name] = value
+				}
+				return true
+			})
+			messages = append(messages, msg)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(messages)
+	case http.MethodDelete:
+		if !queue.CancelScheduled(r.URL.Query().Get("id")) {
+			http.Error(w, "Unknown scheduled message", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
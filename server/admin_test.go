@@ -0,0 +1,55 @@
+package server
+
+import (
+	"encoding/json"
+	"github.com/galtsev/stomp/frame"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAdminScheduled(t *testing.T) {
+	server := NewServer()
+	queue := server.GetDispatcher("/queue/test").(*Queue)
+	sendQueue(queue, "m1", frame.HdrMessageId, "1", frame.HdrDeliverAt, millis(time.Now().Add(time.Hour)))
+	sendQueue(queue, "m2", frame.HdrMessageId, "2", frame.HdrDeliverAt, millis(time.Now().Add(time.Hour)))
+	admin := NewAdminHandler(server)
+
+	req := httptest.NewRequest(http.MethodGet, "/scheduled?destination=/queue/test", nil)
+	resp := httptest.NewRecorder()
+	admin.ServeHTTP(resp, req)
+	assert.Equal(t, http.StatusOK, resp.Code)
+	var messages []scheduledMessage
+	assert.NoError(t, json.Unmarshal(resp.Body.Bytes(), &messages))
+	assert.Equal(t, 2, len(messages))
+	assert.Equal(t, "1", messages[0].MessageId)
+	assert.Equal(t, "/queue/test", messages[0].Headers[frame.HdrDestination])
+
+	req = httptest.NewRequest(http.MethodDelete, "/scheduled?destination=/queue/test&id=1", nil)
+	resp = httptest.NewRecorder()
+	admin.ServeHTTP(resp, req)
+	assert.Equal(t, http.StatusNoContent, resp.Code)
+	assert.Equal(t, 1, len(queue.Scheduled()))
+
+	resp = httptest.NewRecorder()
+	admin.ServeHTTP(resp, req)
+	assert.Equal(t, http.StatusNotFound, resp.Code)
+
+	req = httptest.NewRequest(http.MethodGet, "/scheduled?destination=/queue/unknown", nil)
+	resp = httptest.NewRecorder()
+	admin.ServeHTTP(resp, req)
+	assert.Equal(t, http.StatusNotFound, resp.Code)
+}
+
+func TestAdminAuthorization(t *testing.T) {
+	server := NewServer()
+	server.Authorizer = &RuleAuthorizer{Rules: []Rule{{Pattern: "/queue/>", Users: []string{"root"}, Permissions: PermAdmin}}}
+	server.GetDispatcher("/queue/test")
+	admin := NewAdminHandler(server)
+	req := httptest.NewRequest(http.MethodGet, "/scheduled?destination=/queue/test", nil)
+	resp := httptest.NewRecorder()
+	admin.ServeHTTP(resp, req)
+	assert.Equal(t, http.StatusForbidden, resp.Code)
+}
@@ -0,0 +1,101 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"github.com/galtsev/stomp/frame"
+	"golang.org/x/crypto/bcrypt"
+	"os"
+	"strings"
+)
+
+var ErrAuthenticationFailed = errors.New("Authentication failed")
+
+// Authenticated client
+type Principal struct {
+	Name   string
+	Groups []string
+}
+
+// principal of clients, connected to server without Authenticator
+var Anonymous = &Principal{Name: "anonymous"}
+
+type Authenticator interface {
+	// Authenticate check login and passcode headers of CONNECT frame
+	Authenticate(header frame.Header) (*Principal, error)
+}
+
+type fileUser struct {
+	hash   []byte
+	groups []string
+}
+
+// FileAuthenticator check credentials against htpasswd-like file with lines
+//
+//	login:bcrypt-hash[:group1,group2]
+//
+// Empty lines and lines starting with # are ignored.
+// Hash can be generated with "htpasswd -nB login"
+type FileAuthenticator struct {
+	users map[string]fileUser
+	// hash to check passcode of unknown login against, so that it takes
+	// as long as for known one, and doesn't reveal existing accounts
+	dummyHash []byte
+}
+
+func NewFileAuthenticator(path string) (*FileAuthenticator, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	auth := &FileAuthenticator{
+		users: make(map[string]fileUser),
+	}
+	scanner := bufio.NewScanner(f)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.Split(line, ":")
+		if len(parts) < 2 || len(parts) > 3 || parts[0] == "" {
+			return nil, fmt.Errorf("%s:%d: bad credentials line", path, lineNo)
+		}
+		user := fileUser{hash: []byte(parts[1])}
+		if len(parts) == 3 && parts[2] != "" {
+			user.groups = strings.Split(parts[2], ",")
+		}
+		auth.users[parts[0]] = user
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	cost := bcrypt.MinCost
+	for _, user := range auth.users {
+		if c, err := bcrypt.Cost(user.hash); err == nil && c > cost {
+			cost = c
+		}
+	}
+	if auth.dummyHash, err = bcrypt.GenerateFromPassword([]byte("dummy"), cost); err != nil {
+		return nil, err
+	}
+	return auth, nil
+}
+
+func (a *FileAuthenticator) Authenticate(header frame.Header) (*Principal, error) {
+	login, _ := header.Get(frame.HdrLogin)
+	passcode, _ := header.Get(frame.HdrPasscode)
+	user, ok := a.users[login]
+	if !ok {
+		bcrypt.CompareHashAndPassword(a.dummyHash, []byte(passcode))
+		return nil, ErrAuthenticationFailed
+	}
+	if bcrypt.CompareHashAndPassword(user.hash, []byte(passcode)) != nil {
+		return nil, ErrAuthenticationFailed
+	}
+	return &Principal{Name: login, Groups: user.groups}, nil
+}
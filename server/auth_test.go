@@ -0,0 +1,160 @@
+package server
+
+import (
+	"github.com/galtsev/stomp/frame"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func makeTempFile(t *testing.T, lines ...string) string {
+	f, err := ioutil.TempFile("", "stomp-users")
+	assert.NoError(t, err)
+	defer f.Close()
+	for _, line := range lines {
+		f.WriteString(line + "\n")
+	}
+	return f.Name()
+}
+
+func makeConnectFrame(login, passcode string) *frame.Frame {
+	fr := frame.New()
+	fr.Command = frame.CmdConnect
+	fr.Header.Set(frame.HdrAcceptVersion, frame.V12)
+	fr.Header.Set(frame.HdrLogin, login)
+	fr.Header.Set(frame.HdrPasscode, passcode)
+	return fr
+}
+
+func TestFileAuthenticator(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	assert.NoError(t, err)
+	path := makeTempFile(t, "# comment", "", "bob:"+string(hash)+":admins,users", "eve:"+string(hash))
+	defer os.Remove(path)
+
+	auth, err := NewFileAuthenticator(path)
+	assert.NoError(t, err)
+
+	principal, err := auth.Authenticate(makeConnectFrame("bob", "secret").Header)
+	assert.NoError(t, err)
+	assert.Equal(t, &Principal{Name: "bob", Groups: []string{"admins", "users"}}, principal)
+
+	_, err = auth.Authenticate(makeConnectFrame("bob", "wrong").Header)
+	assert.Equal(t, ErrAuthenticationFailed, err)
+	_, err = auth.Authenticate(makeConnectFrame("alice", "secret").Header)
+	assert.Equal(t, ErrAuthenticationFailed, err)
+}
+
+func TestHandlerAuthentication(t *testing.T) {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	path := makeTempFile(t, "bob:"+string(hash))
+	defer os.Remove(path)
+	auth, err := NewFileAuthenticator(path)
+	assert.NoError(t, err)
+	server := NewServer()
+	server.Authenticator = auth
+
+	expect := func(h *Handler, command string) {
+		select {
+		case fr := <-h.outChan:
+			assert.Equal(t, command, fr.Command)
+		case <-time.NewTimer(time.Second).C:
+			t.Error("Timeout waiting for", command)
+		}
+	}
+
+	// frames before CONNECT are rejected
+	handler := NewHandler(server, nil, nil)
+	go handler.Handle(*makeSubscriptionFrame("sid1", "/queue/1"))
+	expect(handler, frame.CmdError)
+
+	handler = NewHandler(server, nil, nil)
+	go handler.Handle(*makeConnectFrame("bob", "wrong"))
+	expect(handler, frame.CmdError)
+	assert.Nil(t, handler.Principal())
+
+	handler = NewHandler(server, nil, nil)
+	go handler.Handle(*makeConnectFrame("bob", "secret"))
+	expect(handler, frame.CmdConnected)
+	assert.Equal(t, "bob", handler.Principal().Name)
+}
+
+// durable subscription of one user is not available to another one with the same client-id
+func TestDurableSubscriptionOwner(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	assert.NoError(t, err)
+	path := makeTempFile(t, "bob:"+string(hash), "eve:"+string(hash))
+	defer os.Remove(path)
+	server := NewServer()
+	server.Authenticator, err = NewFileAuthenticator(path)
+	assert.NoError(t, err)
+	subscribe := makeSubscriptionFrame("s1", "/topic/test")
+	subscribe.Header.Set(frame.HdrSubscriptionName, "sub")
+	connect := func(login string) *Handler {
+		handler := NewHandler(server, nil, nil)
+		connect := makeConnectFrame(login, "secret")
+		connect.Header.Set(frame.HdrClientId, "client")
+		go handler.Handle(*connect)
+		<-handler.outChan
+		handler.Handle(*subscribe)
+		return handler
+	}
+	connect("bob").Disconnect()
+	server.GetDispatcher("/topic/test").Send(*makeSendFrame("/topic/test", "m1"))
+
+	eve := connect("eve")
+	select {
+	case fr := <-eve.outChan:
+		t.Error("unexpected message", string(fr.Body))
+	case <-time.After(10 * time.Millisecond):
+	}
+	eve.Disconnect()
+	bob := connect("bob")
+	fr := <-bob.outChan
+	assert.Equal(t, "m1", string(fr.Body))
+	bob.Disconnect()
+}
+
+// without authentication client-id alone identify durable subscription
+func TestDurableSubscriptionAnonymous(t *testing.T) {
+	server := NewServer()
+	subscribe := makeSubscriptionFrame("s1", "/topic/test")
+	subscribe.Header.Set(frame.HdrSubscriptionName, "sub")
+	connect := func(clientId string) *Handler {
+		handler := NewHandler(server, nil, nil)
+		connect := frame.New()
+		connect.Command = frame.CmdConnect
+		connect.Header.Set(frame.HdrClientId, clientId)
+		go handler.Handle(*connect)
+		<-handler.outChan
+		return handler
+	}
+	first := connect("client")
+	first.Handle(*subscribe)
+	// active subscription can't be taken over
+	second := connect("client")
+	go second.Handle(*subscribe)
+	fr := <-second.outChan
+	assert.Equal(t, frame.CmdError, fr.Command)
+	second.Disconnect()
+	first.Disconnect()
+	server.GetDispatcher("/topic/test").Send(*makeSendFrame("/topic/test", "m1"))
+
+	other := connect("other")
+	other.Handle(*subscribe)
+	select {
+	case fr := <-other.outChan:
+		t.Error("unexpected message", string(fr.Body))
+	case <-time.After(10 * time.Millisecond):
+	}
+	other.Disconnect()
+	// but other anonymous client with the same client-id resume it
+	third := connect("client")
+	third.Handle(*subscribe)
+	fr = <-third.outChan
+	assert.Equal(t, "m1", string(fr.Body))
+	third.Disconnect()
+}
@@ -1,16 +1,25 @@
 package server
 
 import (
+	"errors"
 	"github.com/galtsev/stomp/frame"
 )
 
+var ErrDuplicateSubscription = errors.New("Subscription id is already used")
+
 type SubscriptionOptions struct {
 	ClientWriteChan chan frame.Frame
-	AddAckCallback  func(msgId string, cb func())
+	// disconnect client, which can't keep up with messages
+	Disconnect func()
+	// client-id of connection, owner of durable subscriptions
+	ClientId string
 }
 
 type Dispatcher interface {
-	Send(fr frame.Frame)
-	Subscribe(fr frame.Frame, options SubscriptionOptions)
+	Send(fr frame.Frame) error
+	Subscribe(fr frame.Frame, options SubscriptionOptions) error
 	Unsubscribe(subscriptionId string)
+	// ACK (or NACK, if ack is false) message, delivered to subscription.
+	// Return false if message is not waiting for acknowledgement
+	Ack(subscriptionId, messageId string, ack bool) bool
 }
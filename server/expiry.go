@@ -0,0 +1,65 @@
+package server
+
+import (
+	"errors"
+	"github.com/galtsev/stomp/frame"
+	"strconv"
+	"time"
+)
+
+var (
+	ErrBadExpires = errors.New("Bad expires header")
+	ErrBadTTL     = errors.New("Bad ttl header")
+)
+
+const DefaultExpirySweepInterval = time.Second
+
+// time in milliseconds since epoch, as in expires header
+func timestamp(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+// replace ttl header of sent message with absolute expires,
+// keeping the earliest of them
+func setExpiration(fr *frame.Frame, now time.Time) error {
+	expires, ok := fr.Header.Get(frame.HdrExpires)
+	if ok {
+		if n, err := strconv.ParseInt(expires, 10, 64); err != nil || n < 0 {
+			return ErrBadExpires
+		}
+	}
+	ttl, ok := fr.Header.Get(frame.HdrTTL)
+	if !ok {
+		return nil
+	}
+	n, err := strconv.ParseInt(ttl, 10, 64)
+	if err != nil || n <= 0 {
+		return ErrBadTTL
+	}
+	fr.Header.Del(frame.HdrTTL)
+	if deadline := timestamp(now) + n; expiration(*fr) == 0 || deadline < expiration(*fr) {
+		fr.Header.Set(frame.HdrExpires, strconv.FormatInt(deadline, 10))
+	}
+	return nil
+}
+
+// value of expires header, 0 if message never expire
+func expiration(fr frame.Frame) int64 {
+	expires, _ := fr.Header.Get(frame.HdrExpires)
+	n, _ := strconv.ParseInt(expires, 10, 64)
+	return n
+}
+
+func expired(fr frame.Frame, now time.Time) bool {
+	expires := expiration(fr)
+	return expires > 0 && expires <= timestamp(now)
+}
+
+// copy of expired message for expiry queue, which doesn't expire again
+func expiredMessage(fr frame.Frame, source string, expiryQueue *Queue) frame.Frame {
+	msg := stripDelivery(fr)
+	msg.Header.Del(frame.HdrExpires)
+	msg.Header.Set(frame.HdrOriginalDestination, source)
+	msg.Header.Set(frame.HdrDestination, expiryQueue.Destination)
+	return msg
+}
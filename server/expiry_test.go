@@ -0,0 +1,98 @@
+package server
+
+import (
+	"github.com/galtsev/stomp/frame"
+	"github.com/stretchr/testify/assert"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestSetExpiration(t *testing.T) {
+	now := time.Unix(1000, 0)
+	cases := []struct {
+		expires, ttl string
+		result       string
+		err          error
+	}{
+		{"", "", "", nil},
+		{"", "500", "1000500", nil},
+		{"2000000", "", "2000000", nil},
+		{"2000000", "500", "1000500", nil},
+		{"1000100", "500", "1000100", nil},
+		{"0", "500", "1000500", nil},
+		{"", "-1", "", ErrBadTTL},
+		{"soon", "", "", ErrBadExpires},
+	}
+	for _, c := range cases {
+		fr := frame.New()
+		if c.expires != "" {
+			fr.Header.Set(frame.HdrExpires, c.expires)
+		}
+		if c.ttl != "" {
+			fr.Header.Set(frame.HdrTTL, c.ttl)
+		}
+		err := setExpiration(fr, now)
+		assert.Equal(t, c.err, err, c.expires+" "+c.ttl)
+		if err != nil {
+			continue
+		}
+		expires, _ := fr.Header.Get(frame.HdrExpires)
+		assert.Equal(t, c.result, expires, c.expires+" "+c.ttl)
+		_, ok := fr.Header.Get(frame.HdrTTL)
+		assert.False(t, ok)
+	}
+}
+
+// time as value of expires or deliver-at header
+func millis(t time.Time) string {
+	return strconv.FormatInt(timestamp(t), 10)
+}
+
+func TestQueueExpiration(t *testing.T) {
+	q := NewQueue("/queue/test")
+	q.ExpiryQueue = NewQueue("/queue/expired")
+	sendQueue(q, "stale", frame.HdrExpires, millis(time.Now().Add(-time.Second)))
+	sendQueue(q, "short", frame.HdrExpires, millis(time.Now().Add(time.Millisecond*10)))
+	sendQueue(q, "long", frame.HdrExpires, millis(time.Now().Add(time.Hour)))
+	sendQueue(q, "forever")
+	time.Sleep(time.Millisecond * 20)
+	q.Sweep()
+	assert.Equal(t, 2, q.Expired())
+	assert.Equal(t, 2, len(q.pending))
+
+	ch := subscribeQueue(q, "s1", frame.AckAuto, frame.HdrPrefetchCount, "16")
+	expectBody(t, ch, "long")
+	expectBody(t, ch, "forever")
+	expectNothing(t, ch)
+
+	expiredCh := subscribeQueue(q.ExpiryQueue, "s1", frame.AckAuto, frame.HdrPrefetchCount, "16")
+	fr := expectBody(t, expiredCh, "stale")
+	source, _ := fr.Header.Get(frame.HdrOriginalDestination)
+	assert.Equal(t, "/queue/test", source)
+	_, ok := fr.Header.Get(frame.HdrExpires)
+	assert.False(t, ok)
+	expectBody(t, expiredCh, "short")
+}
+
+// expired messages are not delivered, even if sweep didn't remove them yet
+func TestQueueExpirationOnDispatch(t *testing.T) {
+	q := NewQueue("/queue/test")
+	sendQueue(q, "short", frame.HdrExpires, millis(time.Now().Add(time.Millisecond*10)))
+	sendQueue(q, "forever")
+	time.Sleep(time.Millisecond * 20)
+	ch := subscribeQueue(q, "s1", frame.AckAuto)
+	expectBody(t, ch, "forever")
+	assert.Equal(t, 1, q.Expired())
+}
+
+func TestTopicExpiration(t *testing.T) {
+	topic := NewTopic("/topic/test")
+	ch := make(chan frame.Frame, 4)
+	subscribeTopic(topic, "s1", ch, nil)
+	sendTopic(topic, "stale", frame.HdrExpires, millis(time.Now().Add(-time.Second)))
+	sendTopic(topic, "fresh", frame.HdrExpires, millis(time.Now().Add(time.Hour)))
+	expectBody(t, ch, "fresh")
+	expectNothing(t, ch)
+	assert.Equal(t, 1, topic.Expired())
+}
@@ -0,0 +1,509 @@
+package server
+
+import (
+	"fmt"
+	"github.com/galtsev/stomp/frame"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// When FileStore flush written records to disk
+type FsyncPolicy int
+
+const (
+	// fsync after every record
+	FsyncAlways FsyncPolicy = iota
+	// fsync every FsyncInterval, Append wait for fsync of it's message,
+	// so that concurrent appends share the same fsync
+	FsyncInterval
+	// leave flushing to operating system, messages may be lost on power failure
+	FsyncNever
+)
+
+type FileStoreOptions struct {
+	Fsync         FsyncPolicy
+	FsyncInterval time.Duration
+	// new segment file is started, when current one grow over SegmentSize bytes
+	SegmentSize int64
+}
+
+var DefaultFileStoreOptions = FileStoreOptions{
+	Fsync:         FsyncInterval,
+	FsyncInterval: 10 * time.Millisecond,
+	SegmentSize:   64 * 1024 * 1024,
+}
+
+const segmentSuffix = ".log"
+
+type storeKey struct {
+	destination string
+	messageId   string
+}
+
+// segment file of log
+type segment struct {
+	num int
+	// appended messages, which are not removed yet
+	live int
+	// all records in file, both appends and removes
+	records int
+}
+
+// segment doesn't contain removed messages or remove records
+func (seg *segment) clean() bool {
+	return seg.live == seg.records
+}
+
+// fsync, shared by appends, waiting for it
+type syncGeneration struct {
+	done chan struct{}
+	err  error
+}
+
+// count bytes, written to segment
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// FileStore is append-only log of frames, split into numbered segment files.
+// Appended message is written as is, removal is written as ACK frame
+// with destination and message-id headers.
+// Log is always continued in new segment after opening, so torn record
+// at the end of segment, written before crash, is never followed by valid one.
+// After rotation, old segments are compacted in background, in order,
+// from oldest to newest: segment without live messages is deleted,
+// segment with dead records is rewritten with live messages only.
+// Processing in order guarantee, that removal records are dropped only
+// together with messages they refer to.
+type FileStore struct {
+	dir     string
+	options FileStoreOptions
+	lock    sync.Mutex
+	// segment number of every live message
+	index    map[storeKey]int
+	segments []*segment
+	file     *os.File
+	out      *countingWriter
+	writer   *frame.Writer
+	dirty    bool
+	gen      *syncGeneration
+	// wake up compactLoop
+	compactions chan struct{}
+	// held by compaction and Iterate, which read old segments
+	compactLock sync.Mutex
+	stop        chan struct{}
+	stopped     sync.WaitGroup
+	closeOnce   sync.Once
+	closeErr    error
+}
+
+func NewFileStore(dir string, options FileStoreOptions) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	s := &FileStore{
+		dir:         dir,
+		options:     options,
+		index:       make(map[storeKey]int),
+		gen:         &syncGeneration{done: make(chan struct{})},
+		compactions: make(chan struct{}, 1),
+		stop:        make(chan struct{}),
+	}
+	names, err := filepath.Glob(filepath.Join(dir, "*"+segmentSuffix))
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		num, err := strconv.Atoi(strings.TrimSuffix(filepath.Base(name), segmentSuffix))
+		if err != nil {
+			continue
+		}
+		s.segments = append(s.segments, &segment{num: num})
+	}
+	sort.Slice(s.segments, func(i, j int) bool {
+		return s.segments[i].num < s.segments[j].num
+	})
+	bySegment := make(map[int]*segment)
+	for _, seg := range s.segments {
+		bySegment[seg.num] = seg
+		err := s.readSegment(seg.num, func(fr *frame.Frame) {
+			seg.records++
+			key := recordKey(fr)
+			if fr.Command == frame.CmdAck {
+				if num, ok := s.index[key]; ok {
+					bySegment[num].live--
+					delete(s.index, key)
+				}
+				return
+			}
+			if num, ok := s.index[key]; ok {
+				// the same message appended again, the last copy wins
+				bySegment[num].live--
+			}
+			s.index[key] = seg.num
+			seg.live++
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	next := 1
+	if len(s.segments) > 0 {
+		next = s.segments[len(s.segments)-1].num + 1
+	}
+	if err := s.openSegment(next); err != nil {
+		return nil, err
+	}
+	if err := s.compact(); err != nil {
+		return nil, err
+	}
+	if s.options.Fsync == FsyncInterval {
+		s.stopped.Add(1)
+		go s.syncLoop()
+	}
+	s.stopped.Add(1)
+	go s.compactLoop()
+	return s, nil
+}
+
+func (s *FileStore) segmentPath(num int) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%08d%s", num, segmentSuffix))
+}
+
+func recordKey(fr *frame.Frame) storeKey {
+	destination, _ := fr.Header.Get(frame.HdrDestination)
+	messageId, _ := fr.Header.Get(frame.HdrMessageId)
+	return storeKey{destination, messageId}
+}
+
+// call fn for every record of segment. Reading stop at the first
+// malformed record, which is expected to be torn write of crashed server
+func (s *FileStore) readSegment(num int, fn func(fr *frame.Frame)) error {
+	f, err := os.Open(s.segmentPath(num))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	reader := frame.NewReader(f)
+	for {
+		fr, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			log.Println("Skip the rest of", s.segmentPath(num), err)
+			return nil
+		}
+		fn(fr)
+	}
+}
+
+// start new current segment. Must be called with s.lock held
+func (s *FileStore) openSegment(num int) error {
+	f, err := os.OpenFile(s.segmentPath(num), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	s.file = f
+	s.out = &countingWriter{w: f}
+	s.writer = frame.NewWriter(s.out)
+	s.writer.AutoContentLength = true
+	s.segments = append(s.segments, &segment{num: num})
+	return syncDir(s.dir)
+}
+
+// make creation, renaming or removal of files in dir durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+func (s *FileStore) current() *segment {
+	return s.segments[len(s.segments)-1]
+}
+
+func (s *FileStore) Append(destination string, fr frame.Frame) error {
+	if value, _ := fr.Header.Get(frame.HdrDestination); value != destination {
+		fr = *fr.Clone()
+		fr.Header.Set(frame.HdrDestination, destination)
+	}
+	s.lock.Lock()
+	if err := s.write(&fr); err != nil {
+		s.lock.Unlock()
+		return err
+	}
+	key := recordKey(&fr)
+	if num, ok := s.index[key]; ok {
+		s.segment(num).live--
+	}
+	s.index[key] = s.current().num
+	s.current().live++
+	gen := s.gen
+	err := s.rotate()
+	s.lock.Unlock()
+	if err != nil {
+		return err
+	}
+	if s.options.Fsync == FsyncInterval {
+		<-gen.done
+		return gen.err
+	}
+	return nil
+}
+
+func (s *FileStore) Remove(destination, messageId string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	key := storeKey{destination, messageId}
+	num, ok := s.index[key]
+	if !ok {
+		return nil
+	}
+	fr := frame.New()
+	fr.Command = frame.CmdAck
+	fr.Header.Set(frame.HdrDestination, destination)
+	fr.Header.Set(frame.HdrMessageId, messageId)
+	if err := s.write(fr); err != nil {
+		return err
+	}
+	delete(s.index, key)
+	s.segment(num).live--
+	return s.rotate()
+}
+
+func (s *FileStore) segment(num int) *segment {
+	for _, seg := range s.segments {
+		if seg.num == num {
+			return seg
+		}
+	}
+	return nil
+}
+
+// write record to current segment. Must be called with s.lock held
+func (s *FileStore) write(fr *frame.Frame) error {
+	if err := s.writer.Write(fr); err != nil {
+		return err
+	}
+	s.current().records++
+	s.dirty = true
+	if s.options.Fsync == FsyncAlways {
+		return s.sync()
+	}
+	return nil
+}
+
+// flush current segment to disk and wake up appends, waiting for it.
+// Must be called with s.lock held
+func (s *FileStore) sync() error {
+	err := s.file.Sync()
+	s.dirty = false
+	gen := s.gen
+	gen.err = err
+	close(gen.done)
+	s.gen = &syncGeneration{done: make(chan struct{})}
+	return err
+}
+
+func (s *FileStore) syncLoop() {
+	defer s.stopped.Done()
+	ticker := time.NewTicker(s.options.FsyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			s.lock.Lock()
+			if s.dirty {
+				if err := s.sync(); err != nil {
+					log.Println("Failed to sync", s.file.Name(), err)
+				}
+			}
+			s.lock.Unlock()
+		}
+	}
+}
+
+// start new segment, if current one is full, and wake up compaction
+// of old segments. Must be called with s.lock held
+func (s *FileStore) rotate() error {
+	if s.options.SegmentSize <= 0 || s.out.n < s.options.SegmentSize {
+		return nil
+	}
+	if err := s.sync(); err != nil {
+		return err
+	}
+	if err := s.file.Close(); err != nil {
+		return err
+	}
+	if err := s.openSegment(s.current().num + 1); err != nil {
+		return err
+	}
+	select {
+	case s.compactions <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// compact old segments without s.lock, not to stall Append and Remove
+func (s *FileStore) compactLoop() {
+	defer s.stopped.Done()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-s.compactions:
+			if err := s.compact(); err != nil {
+				log.Println("Failed to compact", s.dir, err)
+			}
+		}
+	}
+}
+
+// Must be called without s.lock held
+func (s *FileStore) compact() error {
+	s.compactLock.Lock()
+	defer s.compactLock.Unlock()
+	s.lock.Lock()
+	// segments, except current one, don't get new messages, so that
+	// number of their live messages only decrease
+	old := append([]*segment(nil), s.segments[:len(s.segments)-1]...)
+	s.lock.Unlock()
+	deleted := make(map[*segment]bool)
+	defer func() {
+		s.lock.Lock()
+		var kept []*segment
+		for _, seg := range s.segments {
+			if !deleted[seg] {
+				kept = append(kept, seg)
+			}
+		}
+		s.segments = kept
+		s.lock.Unlock()
+	}()
+	for _, seg := range old {
+		s.lock.Lock()
+		live, clean := seg.live, seg.clean()
+		s.lock.Unlock()
+		switch {
+		case live == 0:
+			if err := os.Remove(s.segmentPath(seg.num)); err != nil {
+				return err
+			}
+			deleted[seg] = true
+		case !clean:
+			if err := s.rewrite(seg); err != nil {
+				return err
+			}
+		}
+	}
+	return syncDir(s.dir)
+}
+
+// replace segment file with file, containing only live messages of it.
+// Must be called with s.compactLock held
+func (s *FileStore) rewrite(seg *segment) error {
+	path := s.segmentPath(seg.num)
+	tmp, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	writer := frame.NewWriter(tmp)
+	writer.AutoContentLength = true
+	var writeErr error
+	written := 0
+	err = s.readSegment(seg.num, func(fr *frame.Frame) {
+		if fr.Command == frame.CmdAck || writeErr != nil {
+			return
+		}
+		s.lock.Lock()
+		num, ok := s.index[recordKey(fr)]
+		s.lock.Unlock()
+		if ok && num == seg.num {
+			writeErr = writer.Write(fr)
+			written++
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if writeErr != nil {
+		return writeErr
+	}
+	if err := tmp.Sync(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	// messages, removed during rewrite, are still in file
+	s.lock.Lock()
+	seg.records = written
+	s.lock.Unlock()
+	return nil
+}
+
+func (s *FileStore) Iterate(fn func(destination string, fr frame.Frame)) error {
+	s.compactLock.Lock()
+	defer s.compactLock.Unlock()
+	s.lock.Lock()
+	segments := append([]*segment(nil), s.segments...)
+	s.lock.Unlock()
+	seen := make(map[storeKey]bool)
+	for _, seg := range segments {
+		err := s.readSegment(seg.num, func(fr *frame.Frame) {
+			key := recordKey(fr)
+			if fr.Command == frame.CmdAck || seen[key] {
+				return
+			}
+			s.lock.Lock()
+			num, ok := s.index[key]
+			s.lock.Unlock()
+			if ok && num == seg.num {
+				seen[key] = true
+				fn(key.destination, *fr)
+			}
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close can be called more than once, only the first call close files
+func (s *FileStore) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.stop)
+		s.stopped.Wait()
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		if s.closeErr = s.sync(); s.closeErr != nil {
+			return
+		}
+		s.closeErr = s.file.Close()
+	})
+	return s.closeErr
+}
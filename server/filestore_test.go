@@ -0,0 +1,180 @@
+package server
+
+import (
+	"errors"
+	"github.com/galtsev/stomp/frame"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func makeStoreFrame(id, body string) frame.Frame {
+	fr := frame.New()
+	fr.Command = frame.CmdMessage
+	fr.Header.Set(frame.HdrDestination, "/queue/test")
+	fr.Header.Set(frame.HdrMessageId, id)
+	fr.Header.Set(frame.HdrPersistent, "true")
+	fr.Body = []byte(body)
+	return *fr
+}
+
+// bodies of messages, recovered from store in dir
+func storedBodies(t *testing.T, dir string, options FileStoreOptions) []string {
+	store, err := NewFileStore(dir, options)
+	assert.NoError(t, err)
+	defer store.Close()
+	var bodies []string
+	err = store.Iterate(func(destination string, fr frame.Frame) {
+		assert.Equal(t, "/queue/test", destination)
+		bodies = append(bodies, string(fr.Body))
+	})
+	assert.NoError(t, err)
+	return bodies
+}
+
+func TestFileStoreRecover(t *testing.T) {
+	for _, policy := range []FsyncPolicy{FsyncAlways, FsyncInterval, FsyncNever} {
+		dir := t.TempDir()
+		options := DefaultFileStoreOptions
+		options.Fsync = policy
+		store, err := NewFileStore(dir, options)
+		assert.NoError(t, err)
+		for i := 0; i < 5; i++ {
+			assert.NoError(t, store.Append("/queue/test", makeStoreFrame(strconv.Itoa(i), "m"+strconv.Itoa(i))))
+		}
+		assert.NoError(t, store.Remove("/queue/test", "1"))
+		assert.NoError(t, store.Remove("/queue/test", "3"))
+		assert.NoError(t, store.Close())
+
+		assert.Equal(t, []string{"m0", "m2", "m4"}, storedBodies(t, dir, options))
+		// removal survive the second restart too
+		assert.Equal(t, []string{"m0", "m2", "m4"}, storedBodies(t, dir, options))
+	}
+}
+
+// record, torn by crash in the middle of write, is skipped
+func TestFileStoreTornWrite(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewFileStore(dir, DefaultFileStoreOptions)
+	assert.NoError(t, err)
+	assert.NoError(t, store.Append("/queue/test", makeStoreFrame("1", "m1")))
+	path := store.file.Name()
+	assert.NoError(t, store.Close())
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	assert.NoError(t, err)
+	f.Write([]byte("MESSAGE\ndestination:/queue/test\nmessage-id:2\ncontent-length:100\n\nm2"))
+	f.Close()
+
+	assert.Equal(t, []string{"m1"}, storedBodies(t, dir, DefaultFileStoreOptions))
+}
+
+type failingWriter struct{}
+
+func (w failingWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("no space left on device")
+}
+
+// message, which is not flushed to segment, is not acknowledged
+func TestFileStoreWriteError(t *testing.T) {
+	store, err := NewFileStore(t.TempDir(), DefaultFileStoreOptions)
+	assert.NoError(t, err)
+	defer store.Close()
+	store.lock.Lock()
+	store.writer = frame.NewWriter(failingWriter{})
+	store.lock.Unlock()
+	assert.Error(t, store.Append("/queue/test", makeStoreFrame("1", "m1")))
+}
+
+func TestFileStoreCompaction(t *testing.T) {
+	dir := t.TempDir()
+	options := FileStoreOptions{Fsync: FsyncNever, SegmentSize: 200}
+	store, err := NewFileStore(dir, options)
+	assert.NoError(t, err)
+	for i := 0; i < 100; i++ {
+		assert.NoError(t, store.Append("/queue/test", makeStoreFrame(strconv.Itoa(i), "m"+strconv.Itoa(i))))
+		// keep every 10th message
+		if i%10 != 0 {
+			assert.NoError(t, store.Remove("/queue/test", strconv.Itoa(i)))
+		}
+	}
+	// old segments are compacted in background
+	var segments []string
+	for i := 0; i < 100; i++ {
+		segments, _ = filepath.Glob(filepath.Join(dir, "*"+segmentSuffix))
+		if len(segments) <= 13 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.True(t, len(segments) <= 13, "%d segments", len(segments))
+	assert.NoError(t, store.Close())
+	// second close does nothing
+	assert.NoError(t, store.Close())
+
+	var expect []string
+	for i := 0; i < 100; i += 10 {
+		expect = append(expect, "m"+strconv.Itoa(i))
+	}
+	assert.Equal(t, expect, storedBodies(t, dir, options))
+	segments, _ = filepath.Glob(filepath.Join(dir, "*"+segmentSuffix))
+	// every live message is in it's own small segment at most
+	assert.True(t, len(segments) <= 13, "%d segments", len(segments))
+}
+
+func TestServerRecover(t *testing.T) {
+	dir := t.TempDir()
+	server := NewServer()
+	store, err := NewFileStore(dir, DefaultFileStoreOptions)
+	assert.NoError(t, err)
+	server.Store = store
+	queue := server.GetDispatcher("/queue/test").(*Queue)
+	assert.NoError(t, queue.Send(makeStoreFrame("1", "m1")))
+	assert.NoError(t, queue.Send(makeStoreFrame("2", "m2")))
+	transient := makeStoreFrame("3", "m3")
+	transient.Header.Del(frame.HdrPersistent)
+	assert.NoError(t, queue.Send(transient))
+	ch := subscribeQueue(queue, "s1", frame.AckClientIndividual)
+	fr := expectBody(t, ch, "m1")
+	msgId, _ := fr.Header.Get(frame.HdrMessageId)
+	assert.True(t, queue.Ack("s1", msgId, true))
+	server.Stop()
+
+	server = NewServer()
+	server.Store, err = NewFileStore(dir, DefaultFileStoreOptions)
+	assert.NoError(t, err)
+	assert.NoError(t, server.Recover())
+	queue = server.GetDispatcher("/queue/test").(*Queue)
+	ch = subscribeQueue(queue, "s1", frame.AckAuto)
+	expectBody(t, ch, "m2")
+	expectNothing(t, ch)
+	server.Stop()
+}
+
+func TestServerRecoverPriority(t *testing.T) {
+	dir := t.TempDir()
+	server := NewServer()
+	store, err := NewFileStore(dir, DefaultFileStoreOptions)
+	assert.NoError(t, err)
+	server.Store = store
+	queue := server.GetDispatcher("/queue/test").(*Queue)
+	for i, priority := range []string{"1", "9", "1", "9"} {
+		fr := makeStoreFrame(strconv.Itoa(i), "m"+strconv.Itoa(i))
+		fr.Header.Set(frame.HdrPriority, priority)
+		assert.NoError(t, queue.Send(fr))
+	}
+	server.Stop()
+
+	server = NewServer()
+	server.Store, err = NewFileStore(dir, DefaultFileStoreOptions)
+	assert.NoError(t, err)
+	assert.NoError(t, server.Recover())
+	queue = server.GetDispatcher("/queue/test").(*Queue)
+	ch := subscribeQueue(queue, "s1", frame.AckAuto, frame.HdrPrefetchCount, "16")
+	for _, body := range []string{"m1", "m3", "m0", "m2"} {
+		expectBody(t, ch, body)
+	}
+	server.Stop()
+}
@@ -4,15 +4,48 @@ import (
 	"github.com/galtsev/stomp/frame"
 	"io"
 	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
+var subscriptionLimits = map[string]int{
+	frame.HdrPrefetchCount:    1,
+	frame.HdrConsumerWeight:   1,
+	frame.HdrConsumerPriority: 0,
+}
+
 type Handler struct {
-	Server        *Server
-	id            string
+	Server    *Server
+	id        string
+	version   string
+	connected bool
+	// authenticated client, set on CONNECT
+	principal *Principal
+	// owner of durable subscriptions, set on CONNECT. Client-id of CONNECT
+	// is scoped by principal, so that other users can't attach to durable
+	// subscription with the same client-id. Without Authenticator all clients
+	// are Anonymous, and any of them can resume durable subscription by client-id
+	clientId      string
 	inChan        chan frame.Frame
 	outChan       chan frame.Frame
 	subscriptions map[string]Dispatcher
-	waitingAcks   map[string]func()
+	transactions  transactions
+	// server side names of temporary queues, created by client
+	tempQueues map[string]bool
+	input      *activityReader
+	// negotiated heart-beat intervals
+	sendInterval time.Duration
+	readInterval time.Duration
+	// connection to client, closed on disconnect, may be nil
+	conn io.Closer
+	// closed on disconnect
+	done chan struct{}
+	// closed, when writeLoop is finished
+	written        chan struct{}
+	disconnectOnce sync.Once
+	lock           sync.Mutex
 }
 
 func NewHandler(server *Server, reader io.Reader, writer io.Writer) *Handler {
@@ -22,135 +55,476 @@ func NewHandler(server *Server, reader io.Reader, writer io.Writer) *Handler {
 		inChan:        make(chan frame.Frame),
 		outChan:       make(chan frame.Frame),
 		subscriptions: make(map[string]Dispatcher),
-		waitingAcks:   make(map[string]func()),
+		transactions:  make(transactions),
+		tempQueues:    make(map[string]bool),
+		done:          make(chan struct{}),
+		written:       make(chan struct{}),
+	}
+	if c, ok := writer.(io.Closer); ok {
+		handler.conn = c
+	} else if c, ok := reader.(io.Closer); ok {
+		handler.conn = c
 	}
 	if writer != nil {
 		go handler.writeLoop(writer)
+	} else {
+		close(handler.written)
 	}
 	if reader != nil {
-		go handler.readLoop(reader)
+		handler.input = newActivityReader(reader)
+		go handler.readLoop(handler.input)
 	}
 	go handler.processLoop()
 	return &handler
 }
 
 func (h *Handler) readLoop(r io.Reader) {
-	reader := frame.NewReader(r)
+	reader := frame.NewReaderOptions(r, h.Server.ReaderOptions)
 	for {
 		fr, err := reader.Read()
+		if h.closed() {
+			return
+		}
 		if err == io.EOF {
-			break
+			h.Disconnect()
+			return
 		}
 		if err != nil {
+			// frame limits exceeded or malformed frame,
+			// rest of the stream can't be parsed
 			h.Err(err.Error())
+			return
+		}
+		if fr.Command == frame.CmdConnect || fr.Command == frame.CmdStomp {
+			// frames following CONNECT use negotiated protocol version
+			acceptVersion, _ := fr.Header.Get(frame.HdrAcceptVersion)
+			if version, ok := frame.NegotiateVersion(acceptVersion); ok {
+				reader.Version = version
+			}
+		}
+		select {
+		case h.inChan <- *fr:
+		case <-h.done:
+			return
 		}
-		h.inChan <- *fr
 	}
 }
 
 func (h *Handler) writeLoop(w io.Writer) {
+	defer close(h.written)
 	writer := frame.NewWriter(w)
-	for fr := range h.outChan {
-		writer.Write(&fr)
+	writer.AutoContentLength = true
+	// heart-beats are enabled after CONNECTED frame sent
+	var heartBeat <-chan time.Time
+	lastWrite := time.Now()
+	for {
+		select {
+		case fr := <-h.outChan:
+			writer.Write(&fr)
+			lastWrite = time.Now()
+			if fr.Command == frame.CmdConnected {
+				writer.Version, _ = fr.Header.Get(frame.HdrVersion)
+				if h.sendInterval > 0 {
+					ticker := time.NewTicker(h.sendInterval / 2)
+					defer ticker.Stop()
+					heartBeat = ticker.C
+				}
+			}
+		case <-heartBeat:
+			if time.Since(lastWrite) >= h.sendInterval/2 {
+				writer.WriteHeartBeat()
+				lastWrite = time.Now()
+			}
+		case <-h.done:
+			return
+		}
+	}
+}
+
+// close connection, when the last frame is written to client or,
+// if client doesn't read, after Server.CloseTimeout
+func (h *Handler) closeConn() {
+	timer := time.NewTimer(h.Server.CloseTimeout)
+	defer timer.Stop()
+	select {
+	case <-h.written:
+	case <-timer.C:
+	}
+	if err := h.conn.Close(); err != nil {
+		log.Println("Error closing connection", h.id, err)
 	}
 }
 
 func (h *Handler) processLoop() {
-	for fr := range h.inChan {
-		h.Handle(fr)
+	for {
+		select {
+		case fr := <-h.inChan:
+			h.Handle(fr)
+		case <-h.done:
+			return
+		}
 	}
 }
 
-func (h *Handler) addAckCallBack(msgId string, cb func()) {
-	h.waitingAcks[msgId] = cb
+// disconnect client, which didn't send anything during negotiated heart-beat interval
+func (h *Handler) watchHeartBeats() {
+	// allow some delay in network
+	window := h.readInterval + h.readInterval/2
+	ticker := time.NewTicker(h.readInterval / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if h.input.idle() > window {
+				log.Println("Heart-beat timeout, disconnect", h.id)
+				h.Disconnect()
+				return
+			}
+		case <-h.done:
+			return
+		}
+	}
 }
 
-func (h *Handler) Disconnect() {
-	close(h.inChan)
-	close(h.outChan)
+// authenticated client, nil until CONNECT
+func (h *Handler) Principal() *Principal {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.principal
+}
+
+// ACK or NACK message. Subscription is known only for STOMP 1.0 and 1.1
+func (h *Handler) ack(subscriptionId, messageId string, ack bool) {
+	if subscriptionId != "" {
+		if dispatcher, ok := h.subscriptions[subscriptionId]; ok {
+			dispatcher.Ack(subscriptionId, messageId, ack)
+		}
+		return
+	}
 	for subscriptionId, dispatcher := range h.subscriptions {
-		dispatcher.Unsubscribe(subscriptionId)
+		if dispatcher.Ack(subscriptionId, messageId, ack) {
+			return
+		}
+	}
+}
+
+// send frame to client, unless client is already disconnected
+func (h *Handler) send(fr frame.Frame) {
+	select {
+	case h.outChan <- fr:
+	case <-h.done:
 	}
-	h.Server.RemoveHandler(h)
+}
+
+func (h *Handler) closed() bool {
+	select {
+	case <-h.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (h *Handler) Disconnect() {
+	h.disconnectOnce.Do(func() {
+		close(h.done)
+		h.lock.Lock()
+		for subscriptionId, dispatcher := range h.subscriptions {
+			dispatcher.Unsubscribe(subscriptionId)
+		}
+		h.subscriptions = make(map[string]Dispatcher)
+		// uncommitted transactions are aborted
+		h.transactions = make(transactions)
+		for name := range h.tempQueues {
+			h.Server.deleteQueue(name)
+		}
+		h.tempQueues = make(map[string]bool)
+		h.lock.Unlock()
+		h.Server.RemoveHandler(h)
+		if h.conn != nil {
+			go h.closeConn()
+		}
+	})
 }
 
 func (h *Handler) Err(msg string) {
-	log.Println("ERROR", msg)
-	fr := frame.New()
-	fr.Command = frame.CmdError
-	fr.Header.Set(frame.HdrMessage, msg)
-	h.outChan <- *fr
+	h.err(msg)
 	h.Disconnect()
 }
 
 func (h *Handler) Handle(fr frame.Frame) {
+	h.lock.Lock()
+	if h.closed() {
+		h.lock.Unlock()
+		return
+	}
+	disconnect := h.handle(fr)
+	h.lock.Unlock()
+	if disconnect {
+		h.Disconnect()
+	}
+}
+
+// return true if client must be disconnected
+func (h *Handler) handle(fr frame.Frame) bool {
+	if !h.connected && h.Server.Authenticator != nil && fr.Command != frame.CmdConnect && fr.Command != frame.CmdStomp {
+		return h.errFor(fr, "Not connected")
+	}
 	switch fr.Command {
 
 	case frame.CmdConnect, frame.CmdStomp:
-		fr := frame.New()
-		fr.Command = frame.CmdConnected
-		fr.Header.Set(frame.HdrVersion, "1.2")
-		h.outChan <- *fr
+		acceptVersion, _ := fr.Header.Get(frame.HdrAcceptVersion)
+		version, ok := frame.NegotiateVersion(acceptVersion)
+		if !ok {
+			errFr := errorFrame("Supported protocol versions are " + strings.Join(frame.SupportedVersions, ","))
+			errFr.Header.Set(frame.HdrVersion, strings.Join(frame.SupportedVersions, ","))
+			h.send(*errFr)
+			return true
+		}
+		principal := Anonymous
+		if h.Server.Authenticator != nil {
+			var err error
+			principal, err = h.Server.Authenticator.Authenticate(fr.Header)
+			if err != nil {
+				login, _ := fr.Header.Get(frame.HdrLogin)
+				log.Println("Failed to authenticate", login, err)
+				return h.errFor(fr, err.Error())
+			}
+		}
+		h.principal = principal
+		if clientId, ok := fr.Header.Get(frame.HdrClientId); ok && clientId != "" {
+			h.clientId = principal.Name + ":" + clientId
+		}
+		h.connected = true
+		h.version = version
+		outFr := frame.New()
+		outFr.Command = frame.CmdConnected
+		outFr.Header.Set(frame.HdrVersion, version)
+		if heartBeat, ok := fr.Header.Get(frame.HdrHeartBeat); ok {
+			cx, cy, err := parseHeartBeat(heartBeat)
+			if err != nil {
+				return h.errFor(fr, err.Error())
+			}
+			h.sendInterval = heartBeatInterval(h.Server.HeartBeatSend, cy)
+			h.readInterval = heartBeatInterval(cx, h.Server.HeartBeatReceive)
+		}
+		outFr.Header.Set(frame.HdrHeartBeat, formatHeartBeat(h.Server.HeartBeatSend, h.Server.HeartBeatReceive))
+		h.send(*outFr)
+		if h.readInterval > 0 && h.input != nil {
+			go h.watchHeartBeats()
+		}
 
 	case frame.CmdDisconnect:
-		defer h.Disconnect()
+		h.receipt(fr)
+		return true
 
 	case frame.CmdSubscribe:
 		destination, ok := fr.Header.Get(frame.HdrDestination)
 		if !ok {
-			h.Err("Missing destination header")
+			return h.errFor(fr, "Missing destination header")
 		}
 		subscriptionId, ok := fr.Header.Get(frame.HdrId)
 		if !ok {
-			h.Err("Missing subscription id header")
+			return h.errFor(fr, "Missing subscription id header")
+		}
+		if _, ok := h.subscriptions[subscriptionId]; ok {
+			return h.errFor(fr, ErrDuplicateSubscription.Error()+": "+subscriptionId)
+		}
+		// numeric options of subscription and their minimal values
+		for name, min := range subscriptionLimits {
+			if value, ok := fr.Header.Get(name); ok {
+				if n, err := strconv.Atoi(value); err != nil || n < min {
+					return h.errFor(fr, "Bad "+name+" header "+value)
+				}
+			}
+		}
+		if err := h.authorize(PermRead, destination); err != nil {
+			return h.errFor(fr, err.Error()+" to "+destination)
+		}
+		destination = h.resolve(destination)
+		if isTempQueue(destination) && !h.tempQueues[destination] {
+			return h.errFor(fr, ErrForeignTempQueue.Error())
 		}
 		dispatcher := h.Server.GetDispatcher(destination)
-		h.subscriptions[subscriptionId] = dispatcher
 		options := SubscriptionOptions{
 			ClientWriteChan: h.outChan,
-			AddAckCallback:  h.addAckCallBack,
+			Disconnect:      h.Disconnect,
+			ClientId:        h.clientId,
+		}
+		if err := dispatcher.Subscribe(fr, options); err != nil {
+			return h.errFor(fr, err.Error())
 		}
-		dispatcher.Subscribe(fr, options)
+		h.subscriptions[subscriptionId] = dispatcher
 
 	case frame.CmdUnsubscribe:
 		subscriptionId, ok := fr.Header.Get(frame.HdrId)
 		if !ok {
-			h.Err("Missing subscription id header")
+			return h.errFor(fr, "Missing subscription id header")
 		}
-		if dispatcher, ok := h.subscriptions[subscriptionId]; ok {
+		dispatcher, ok := h.subscriptions[subscriptionId]
+		if ok {
 			delete(h.subscriptions, subscriptionId)
 			dispatcher.Unsubscribe(subscriptionId)
 		}
+		// subscription-name header remove durable subscription,
+		// which is found by destination, if client is not subscribed now
+		if name, durable := fr.Header.Get(frame.HdrSubscriptionName); durable {
+			if destination, found := fr.Header.Get(frame.HdrDestination); found && !ok {
+				if err := h.authorize(PermRead, destination); err != nil {
+					return h.errFor(fr, err.Error()+" to "+destination)
+				}
+				dispatcher, _ = h.Server.findDispatcher(destination)
+			}
+			if topic, isTopic := dispatcher.(*Topic); !isTopic || !topic.RemoveDurable(h.clientId, name) {
+				return h.errFor(fr, "Unknown durable subscription "+name)
+			}
+		}
 
 	case frame.CmdSend:
 		destination, ok := fr.Header.Get(frame.HdrDestination)
 		if !ok {
-			h.Err("Missing destination header")
+			return h.errFor(fr, "Missing destination header")
+		}
+		destinations, err := splitDestinations(destination)
+		if err != nil {
+			return h.errFor(fr, err.Error())
+		}
+		for _, destination := range destinations {
+			if err := h.authorize(PermWrite, destination); err != nil {
+				return h.errFor(fr, err.Error()+" to "+destination)
+			}
+		}
+		for i := range destinations {
+			destinations[i] = h.resolve(destinations[i])
+			if isQueue(destinations[i]) {
+				continue
+			}
+			if isWildcard(destinations[i]) {
+				return h.errFor(fr, "Can't send to wildcard destination "+destinations[i])
+			}
+			if isScheduled(fr) {
+				return h.errFor(fr, ErrScheduledNonQueue.Error()+", not "+destinations[i])
+			}
 		}
-		dispatcher := h.Server.GetDispatcher(destination)
 		outFr := fr.Clone()
 		outFr.Command = frame.CmdMessage
-		dispatcher.Send(*outFr)
+		outFr.Header.Del(frame.HdrTransaction)
+		// message-id is assigned by server, ids of clients may be not unique
+		outFr.Header.Del(frame.HdrMessageId)
+		if replyTo, ok := outFr.Header.Get(frame.HdrReplyTo); ok {
+			outFr.Header.Set(frame.HdrReplyTo, h.resolve(replyTo))
+		}
+		if err := setExpiration(outFr, time.Now()); err != nil {
+			return h.errFor(fr, err.Error())
+		}
+		if err := setSchedule(outFr, time.Now()); err != nil {
+			return h.errFor(fr, err.Error())
+		}
+		if value, ok := fr.Header.Get(frame.HdrPriority); ok {
+			if n, err := strconv.Atoi(value); err != nil || n < MinPriority || n > MaxPriority {
+				return h.errFor(fr, "Bad priority header "+value)
+			}
+		}
+		var d delivery
+		err = h.transactions.perform(fr, action{
+			prepare: func() (err error) {
+				d, err = h.Server.prepareSend(destinations, *outFr)
+				return err
+			},
+			commit:   func() { d.commit() },
+			rollback: func() { d.rollback() },
+		})
+		if err != nil {
+			return h.errFor(fr, err.Error())
+		}
 
-	case frame.CmdAck:
+	case frame.CmdAck, frame.CmdNack:
+		// STOMP 1.2 use ack header of MESSAGE as id,
+		// while older versions use message-id and subscription
 		id, ok := fr.Header.Get(frame.HdrId)
 		if !ok {
-			h.Err("Missing Id header")
+			id, ok = fr.Header.Get(frame.HdrMessageId)
 		}
-		wh, ok := h.waitingAcks[id]
-		if ok {
-			delete(h.waitingAcks, id)
-			wh()
+		if !ok {
+			return h.errFor(fr, "Missing Id header")
+		}
+		subscriptionId, _ := fr.Header.Get(frame.HdrSubscription)
+		ack := fr.Command == frame.CmdAck
+		err := h.transactions.perform(fr, action{
+			prepare:  func() error { return nil },
+			commit:   func() { h.ack(subscriptionId, id, ack) },
+			rollback: func() {},
+		})
+		if err != nil {
+			return h.errFor(fr, err.Error())
+		}
+
+	case frame.CmdBegin:
+		if err := h.transactions.begin(fr); err != nil {
+			return h.errFor(fr, err.Error())
+		}
+
+	case frame.CmdCommit:
+		actions, err := h.transactions.end(fr)
+		if err != nil {
+			return h.errFor(fr, err.Error())
+		}
+		if err := commit(actions); err != nil {
+			return h.errFor(fr, err.Error())
+		}
+
+	case frame.CmdAbort:
+		if _, err := h.transactions.end(fr); err != nil {
+			return h.errFor(fr, err.Error())
 		}
 	default:
-		h.Err("Unknown command: " + fr.Command)
+		return h.errFor(fr, "Unknown command: "+fr.Command)
+	}
+
+	h.receipt(fr)
+	return false
+}
+
+func errorFrame(msg string) *frame.Frame {
+	log.Println("ERROR", msg)
+	fr := frame.New()
+	fr.Command = frame.CmdError
+	fr.Header.Set(frame.HdrMessage, msg)
+	return fr
+}
+
+// send ERROR frame, client must be disconnected after that
+func (h *Handler) err(msg string) bool {
+	h.send(*errorFrame(msg))
+	return true
+}
+
+// send ERROR frame, caused by client frame, correlated by receipt-id
+func (h *Handler) errFor(cause frame.Frame, msg string) bool {
+	fr := errorFrame(msg)
+	if receiptId, ok := cause.Header.Get(frame.HdrReceipt); ok {
+		fr.Header.Set(frame.HdrReceiptId, receiptId)
 	}
+	h.send(*fr)
+	return true
+}
+
+func (h *Handler) authorize(perm Permission, destination string) error {
+	if h.Server.Authorizer == nil {
+		return nil
+	}
+	principal := h.principal
+	if principal == nil {
+		principal = Anonymous
+	}
+	return h.Server.Authorizer.Authorize(principal, perm, destination)
+}
 
+func (h *Handler) receipt(fr frame.Frame) {
 	if receiptId, ok := fr.Header.Get(frame.HdrReceipt); ok {
 		recFrame := frame.New()
 		recFrame.Command = frame.CmdReceipt
 		recFrame.Header.Set(frame.HdrReceiptId, receiptId)
-		h.outChan <- *recFrame
+		h.send(*recFrame)
 	}
-
 }
@@ -5,6 +5,7 @@ import (
 	"github.com/galtsev/stomp/frame"
 	"github.com/stretchr/testify/assert"
 	"io"
+	"net"
 	"sync"
 	"testing"
 	"time"
@@ -54,6 +55,125 @@ func TestHandlerSubscribeAndSend(t *testing.T) {
 	}
 }
 
+func TestHandlerConnectVersion(t *testing.T) {
+	server := NewServer()
+	handler := NewHandler(server, nil, nil)
+
+	fr := frame.New()
+	fr.Command = frame.CmdConnect
+	fr.Header.Set(frame.HdrAcceptVersion, "1.0,1.1")
+	go handler.Handle(*fr)
+
+	select {
+	case outFr := <-handler.outChan:
+		assert.Equal(t, frame.CmdConnected, outFr.Command)
+		version, _ := outFr.Header.Get(frame.HdrVersion)
+		assert.Equal(t, frame.V11, version)
+	case <-time.NewTimer(time.Millisecond * 10).C:
+		t.Error("Timeout getting CONNECTED frame")
+	}
+}
+
+func makeTxFrame(command, txId string) *frame.Frame {
+	fr := frame.New()
+	fr.Command = command
+	fr.Header.Set(frame.HdrTransaction, txId)
+	return fr
+}
+
+func TestHandlerTransaction(t *testing.T) {
+	server := NewServer()
+	consumer := NewHandler(server, nil, nil)
+	producer := NewHandler(server, nil, nil)
+	consumer.Handle(*makeSubscriptionFrame("sid1", "/queue/tx"))
+
+	expectNone := func() {
+		select {
+		case fr := <-consumer.outChan:
+			t.Error("Unexpected message", string(fr.Body))
+		case <-time.NewTimer(time.Millisecond * 5).C:
+		}
+	}
+	sendTx := func(txId, body string) {
+		fr := makeSendFrame("/queue/tx", body)
+		fr.Header.Set(frame.HdrTransaction, txId)
+		producer.Handle(*fr)
+	}
+
+	// aborted transaction
+	producer.Handle(*makeTxFrame(frame.CmdBegin, "tx1"))
+	sendTx("tx1", "aborted")
+	producer.Handle(*makeTxFrame(frame.CmdAbort, "tx1"))
+	expectNone()
+
+	// committed transaction
+	producer.Handle(*makeTxFrame(frame.CmdBegin, "tx2"))
+	sendTx("tx2", "msg1")
+	sendTx("tx2", "msg2")
+	expectNone()
+	producer.Handle(*makeTxFrame(frame.CmdCommit, "tx2"))
+	for _, body := range []string{"msg1", "msg2"} {
+		select {
+		case fr := <-consumer.outChan:
+			assert.Equal(t, []byte(body), fr.Body)
+			_, ok := fr.Header.Get(frame.HdrTransaction)
+			assert.False(t, ok)
+		case <-time.NewTimer(time.Millisecond * 10).C:
+			t.Error("Timeout getting committed message")
+		}
+	}
+
+	// transaction is finished
+	go sendTx("tx2", "unknown")
+	select {
+	case fr := <-producer.outChan:
+		assert.Equal(t, frame.CmdError, fr.Command)
+	case <-time.NewTimer(time.Millisecond * 10).C:
+		t.Error("Timeout getting ERROR frame")
+	}
+}
+
+func TestHandlerAck(t *testing.T) {
+	server := NewServer()
+	handler := NewHandler(server, nil, nil)
+	subFr := makeSubscriptionFrame("sid1", "/queue/ack")
+	subFr.Header.Set(frame.HdrAck, frame.AckClientIndividual)
+	handler.Handle(*subFr)
+	handler.Handle(*makeSendFrame("/queue/ack", "msg1"))
+	handler.Handle(*makeSendFrame("/queue/ack", "msg2"))
+
+	receive := func(body string) frame.Frame {
+		select {
+		case fr := <-handler.outChan:
+			assert.Equal(t, []byte(body), fr.Body)
+			return fr
+		case <-time.NewTimer(time.Millisecond * 10).C:
+			t.Fatal("Timeout getting", body)
+		}
+		return frame.Frame{}
+	}
+	fr := receive("msg1")
+	// STOMP 1.1 style acknowledgement
+	ackFr := frame.New()
+	ackFr.Command = frame.CmdAck
+	msgId, _ := fr.Header.Get(frame.HdrMessageId)
+	ackFr.Header.Set(frame.HdrMessageId, msgId)
+	ackFr.Header.Set(frame.HdrSubscription, "sid1")
+	handler.Handle(*ackFr)
+
+	fr = receive("msg2")
+	// STOMP 1.2 style negative acknowledgement
+	nackFr := frame.New()
+	nackFr.Command = frame.CmdNack
+	ackId, _ := fr.Header.Get(frame.HdrAck)
+	nackFr.Header.Set(frame.HdrId, ackId)
+	handler.Handle(*nackFr)
+
+	fr = receive("msg2")
+	count, _ := fr.Header.Get(frame.HdrRedeliveryCount)
+	assert.Equal(t, "1", count)
+}
+
 type TestMsg struct {
 	client int    // client which must receive this message
 	msgId  string // for x-msg-id custom header
@@ -69,6 +189,56 @@ type TestMsg struct {
 // 1 message to /queue/3 (no subscriptions yet)
 // client 2 subscribed to /queue/3 (sid3)
 // check that all 4 messages delivered to correct destination
+func TestHandlerDurableSubscription(t *testing.T) {
+	server := NewServer()
+	connect := frame.New()
+	connect.Command = frame.CmdConnect
+	connect.Header.Set(frame.HdrClientId, "client")
+	subscribe := makeSubscriptionFrame("s1", "/topic/test")
+	subscribe.Header.Set(frame.HdrSubscriptionName, "sub")
+
+	handler := NewHandler(server, nil, nil)
+	go handler.Handle(*connect)
+	<-handler.outChan
+	handler.Handle(*subscribe)
+	handler.Disconnect()
+
+	// published while subscriber is offline
+	server.GetDispatcher("/topic/test").Send(*makeSendFrame("/topic/test", "m1"))
+
+	handler = NewHandler(server, nil, nil)
+	go handler.Handle(*connect)
+	<-handler.outChan
+	handler.Handle(*subscribe)
+	select {
+	case fr := <-handler.outChan:
+		assert.Equal(t, "m1", string(fr.Body))
+	case <-time.After(time.Second):
+		t.Fatal("timeout receiving accumulated message")
+	}
+
+	unsubscribe := frame.New()
+	unsubscribe.Command = frame.CmdUnsubscribe
+	unsubscribe.Header.Set(frame.HdrId, "s1")
+	unsubscribe.Header.Set(frame.HdrSubscriptionName, "sub")
+	handler.Handle(*unsubscribe)
+	assert.False(t, server.GetDispatcher("/topic/test").(*Topic).RemoveDurable("anonymous:client", "sub"))
+
+	// unknown durable subscriptions are reported, topics are not created for them
+	handler.Disconnect()
+	for _, destination := range []string{"/topic/test", "/topic/missing"} {
+		handler = NewHandler(server, nil, nil)
+		go handler.Handle(*connect)
+		<-handler.outChan
+		unsubscribe.Header.Set(frame.HdrDestination, destination)
+		go handler.Handle(*unsubscribe)
+		fr := <-handler.outChan
+		assert.Equal(t, frame.CmdError, fr.Command)
+	}
+	_, ok := server.findDispatcher("/topic/missing")
+	assert.False(t, ok)
+}
+
 func TestDispatchThreeSubscriptions(t *testing.T) {
 	var data []TestMsg = []TestMsg{
 		{client: 1, msgId: "1", sId: "sid1", dest: "/queue/1", body: "body1"},
@@ -187,6 +357,25 @@ func TestHandlerReaderWriter(t *testing.T) {
 	consumer.Disconnect()
 }
 
+func TestHandlerFrameTooLarge(t *testing.T) {
+	server := NewServer()
+	server.ReaderOptions.MaxBodySize = 8
+	reader, hWriter := io.Pipe()
+	hReader, writer := io.Pipe()
+	NewHandler(server, hReader, hWriter)
+
+	go writer.Write([]byte("SEND\ndestination:/queue/1\n\nthis body is too large\x00"))
+
+	fr, err := frame.NewReader(reader).Read()
+	assert.NoError(t, err)
+	assert.Equal(t, frame.CmdError, fr.Command)
+	msg, _ := fr.Header.Get(frame.HdrMessage)
+	assert.Equal(t, frame.BodyTooLargeError{Limit: 8}.Error(), msg)
+	// connection closed after ERROR frame
+	_, err = frame.NewReader(reader).Read()
+	assert.Equal(t, io.EOF, err)
+}
+
 func BenchmarkHandlerReaderWriter(b *testing.B) {
 	server := NewServer()
 	makeConn := func() (reader io.Reader, writer io.Writer, h *Handler) {
@@ -264,3 +453,174 @@ func BenchmarkHandlerOne(b *testing.B) {
 	wg.Wait()
 
 }
+
+func TestHandlerCompositeSend(t *testing.T) {
+	server := NewServer()
+	server.Authorizer = &RuleAuthorizer{Rules: []Rule{
+		{Pattern: "/queue/secret", Users: []string{"root"}, Permissions: PermWrite},
+		{Pattern: "/queue/a", Users: []string{"anonymous"}, Permissions: PermWrite},
+		{Pattern: "/topic/t", Users: []string{"anonymous"}, Permissions: PermWrite},
+	}}
+	handler := NewHandler(server, nil, nil)
+	a := subscribeQueue(server.GetDispatcher("/queue/a").(*Queue), "s1", frame.AckAuto)
+	topic := make(chan frame.Frame, 4)
+	subscribeTopic(server.GetDispatcher("/topic/t").(*Topic), "s2", topic, nil)
+
+	send := makeSendFrame("/queue/a, /topic/t", "m1")
+	send.Header.Set(frame.HdrReceipt, "r1")
+	go handler.Handle(*send)
+	receipt := <-handler.outChan
+	assert.Equal(t, frame.CmdReceipt, receipt.Command)
+	fr := expectBody(t, a, "m1")
+	destination, _ := fr.Header.Get(frame.HdrDestination)
+	assert.Equal(t, "/queue/a", destination)
+	fr = expectBody(t, topic, "m1")
+	destination, _ = fr.Header.Get(frame.HdrDestination)
+	assert.Equal(t, "/topic/t", destination)
+
+	// nothing is delivered, if one of destinations is denied
+	go handler.Handle(*makeSendFrame("/queue/a,/queue/secret", "m2"))
+	errFr := <-handler.outChan
+	assert.Equal(t, frame.CmdError, errFr.Command)
+	expectNothing(t, a)
+}
+
+func TestCompositeSendAtomic(t *testing.T) {
+	server := NewServer()
+	full := server.GetDispatcher("/queue/full").(*Queue)
+	full.Limits = QueueLimits{MaxMessages: 1, Overflow: OverflowReject}
+	sendQueue(full, "m0")
+	a := subscribeQueue(server.GetDispatcher("/queue/a").(*Queue), "s1", frame.AckAuto)
+	topic := make(chan frame.Frame, 4)
+	subscribeTopic(server.GetDispatcher("/topic/t").(*Topic), "s2", topic, nil)
+	err := server.Send([]string{"/topic/t", "/queue/a", "/queue/full"}, *makeSendFrame("", "m1"))
+	assert.Error(t, err)
+	// nothing is delivered even to consumer, which could get message at once
+	expectNothing(t, a)
+	expectNothing(t, topic)
+
+	// copies have their own message-id
+	b := subscribeQueue(server.GetDispatcher("/queue/b").(*Queue), "s3", frame.AckAuto)
+	assert.NoError(t, server.Send([]string{"/queue/a", "/queue/b"}, *makeSendFrame("", "m2")))
+	frA, frB := expectBody(t, a, "m2"), expectBody(t, b, "m2")
+	idA, _ := frA.Header.Get(frame.HdrMessageId)
+	idB, _ := frB.Header.Get(frame.HdrMessageId)
+	assert.NotEqual(t, idA, idB)
+}
+
+func TestHandlerTempQueue(t *testing.T) {
+	server := NewServer()
+	owner := NewHandler(server, nil, nil)
+	owner.Handle(*makeSubscriptionFrame("s1", "/temp-queue/replies"))
+
+	// reply-to is rewritten to server side name
+	requests := subscribeQueue(server.GetDispatcher("/queue/requests").(*Queue), "s2", frame.AckAuto)
+	request := makeSendFrame("/queue/requests", "ping")
+	request.Header.Set(frame.HdrReplyTo, "/temp-queue/replies")
+	owner.Handle(*request)
+	fr := expectBody(t, requests, "ping")
+	replyTo, _ := fr.Header.Get(frame.HdrReplyTo)
+	assert.Equal(t, "/queue/temp."+owner.id+".replies", replyTo)
+
+	// other client send reply to it
+	other := NewHandler(server, nil, nil)
+	other.Handle(*makeSendFrame(replyTo, "pong"))
+	select {
+	case fr := <-owner.outChan:
+		assert.Equal(t, "pong", string(fr.Body))
+	case <-time.After(time.Second):
+		t.Fatal("timeout receiving reply")
+	}
+
+	// but can't subscribe to it
+	go other.Handle(*makeSubscriptionFrame("s3", replyTo))
+	errFr := <-other.outChan
+	assert.Equal(t, frame.CmdError, errFr.Command)
+
+	// queue and it's backlog are deleted with connection
+	owner.Handle(*makeSendFrame("/temp-queue/replies", "lost"))
+	owner.Disconnect()
+	server.dispLock.RLock()
+	_, ok := server.Dispatchers[replyTo]
+	server.dispLock.RUnlock()
+	assert.False(t, ok)
+
+	// late reply is dropped, responder stays connected
+	responder := NewHandler(server, nil, nil)
+	late := makeSendFrame(replyTo, "late")
+	late.Header.Set(frame.HdrReceipt, "r1")
+	go responder.Handle(*late)
+	fr = <-responder.outChan
+	assert.Equal(t, frame.CmdReceipt, fr.Command)
+	assert.False(t, responder.closed())
+	server.dispLock.RLock()
+	_, ok = server.Dispatchers[replyTo]
+	server.dispLock.RUnlock()
+	assert.False(t, ok)
+}
+
+// connection of client, which doesn't read, is closed anyway
+func TestHandlerDisconnectStalled(t *testing.T) {
+	server := NewServer()
+	server.CloseTimeout = 10 * time.Millisecond
+	conn, client := net.Pipe()
+	h := NewHandler(server, conn, conn)
+	client.Write([]byte("CONNECT\naccept-version:1.2\n\n\x00"))
+	// CONNECTED frame is never read
+	h.Disconnect()
+	time.Sleep(50 * time.Millisecond)
+	_, err := client.Write([]byte("\n"))
+	assert.Equal(t, io.ErrClosedPipe, err)
+}
+
+// message-id of SEND is replaced with unique one
+func TestHandlerMessageId(t *testing.T) {
+	server := NewServer()
+	handler := NewHandler(server, nil, nil)
+	subscribe := makeSubscriptionFrame("s1", "/queue/ids")
+	subscribe.Header.Set(frame.HdrAck, frame.AckClientIndividual)
+	subscribe.Header.Set(frame.HdrPrefetchCount, "2")
+	handler.Handle(*subscribe)
+	for _, body := range []string{"m1", "m2"} {
+		send := makeSendFrame("/queue/ids", body)
+		send.Header.Set(frame.HdrMessageId, "same")
+		handler.Handle(*send)
+	}
+	fr1, fr2 := <-handler.outChan, <-handler.outChan
+	id1, _ := fr1.Header.Get(frame.HdrMessageId)
+	id2, _ := fr2.Header.Get(frame.HdrMessageId)
+	assert.NotEqual(t, "same", id1)
+	assert.NotEqual(t, id1, id2)
+	assert.True(t, server.GetDispatcher("/queue/ids").Ack("s1", id2, true))
+	assert.True(t, server.GetDispatcher("/queue/ids").Ack("s1", id1, true))
+}
+
+// transaction, which SEND can't be done, is not committed at all
+func TestHandlerTransactionAtomic(t *testing.T) {
+	server := NewServer()
+	queue := server.GetDispatcher("/queue/tx").(*Queue)
+	queue.Limits = QueueLimits{MaxMessages: 2, Overflow: OverflowReject}
+	producer := NewHandler(server, nil, nil)
+	producer.Handle(*makeTxFrame(frame.CmdBegin, "tx1"))
+	for _, body := range []string{"m1", "m2", "m3"} {
+		fr := makeSendFrame("/queue/tx", body)
+		fr.Header.Set(frame.HdrTransaction, "tx1")
+		producer.Handle(*fr)
+	}
+	go producer.Handle(*makeTxFrame(frame.CmdCommit, "tx1"))
+	fr := <-producer.outChan
+	assert.Equal(t, frame.CmdError, fr.Command)
+	queue.lock.Lock()
+	assert.Equal(t, 0, len(queue.pending))
+	assert.Equal(t, 0, queue.reserved)
+	queue.lock.Unlock()
+}
+
+func TestHandlerDuplicateSubscription(t *testing.T) {
+	server := NewServer()
+	handler := NewHandler(server, nil, nil)
+	handler.Handle(*makeSubscriptionFrame("s1", "/queue/a"))
+	go handler.Handle(*makeSubscriptionFrame("s1", "/queue/b"))
+	fr := <-handler.outChan
+	assert.Equal(t, frame.CmdError, fr.Command)
+}
@@ -0,0 +1,68 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// parse heart-beat header value "cx,cy", where both values are in milliseconds
+func parseHeartBeat(value string) (cx, cy time.Duration, err error) {
+	parts := strings.Split(value, ",")
+	if len(parts) != 2 {
+		return 0, 0, errors.New("Bad heart-beat header " + value)
+	}
+	x, err := strconv.ParseUint(strings.TrimSpace(parts[0]), 10, 32)
+	if err != nil {
+		return 0, 0, err
+	}
+	y, err := strconv.ParseUint(strings.TrimSpace(parts[1]), 10, 32)
+	if err != nil {
+		return 0, 0, err
+	}
+	return time.Duration(x) * time.Millisecond, time.Duration(y) * time.Millisecond, nil
+}
+
+func formatHeartBeat(cx, cy time.Duration) string {
+	return strconv.FormatInt(int64(cx/time.Millisecond), 10) + "," + strconv.FormatInt(int64(cy/time.Millisecond), 10)
+}
+
+// negotiated interval is the largest of two intervals, zero if any side can't do heart-beats
+func heartBeatInterval(a, b time.Duration) time.Duration {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// io.Reader, which remember time of the last successful read,
+// including heart-beats, which never reach frame level
+type activityReader struct {
+	r        io.Reader
+	lastRead int64
+}
+
+func newActivityReader(r io.Reader) *activityReader {
+	return &activityReader{
+		r:        r,
+		lastRead: time.Now().UnixNano(),
+	}
+}
+
+func (a *activityReader) Read(p []byte) (int, error) {
+	n, err := a.r.Read(p)
+	if n > 0 {
+		atomic.StoreInt64(&a.lastRead, time.Now().UnixNano())
+	}
+	return n, err
+}
+
+func (a *activityReader) idle() time.Duration {
+	return time.Duration(time.Now().UnixNano() - atomic.LoadInt64(&a.lastRead))
+}
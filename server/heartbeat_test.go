@@ -0,0 +1,87 @@
+package server
+
+import (
+	"bufio"
+	"github.com/galtsev/stomp/frame"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestParseHeartBeat(t *testing.T) {
+	cx, cy, err := parseHeartBeat("100,2000")
+	assert.NoError(t, err)
+	assert.Equal(t, 100*time.Millisecond, cx)
+	assert.Equal(t, 2*time.Second, cy)
+	assert.Equal(t, "100,2000", formatHeartBeat(cx, cy))
+
+	_, _, err = parseHeartBeat("100")
+	assert.Error(t, err)
+	_, _, err = parseHeartBeat("a,b")
+	assert.Error(t, err)
+
+	assert.Equal(t, time.Duration(0), heartBeatInterval(0, time.Second))
+	assert.Equal(t, 2*time.Second, heartBeatInterval(2*time.Second, time.Second))
+}
+
+func connectPipe(server *Server, heartBeat string) (*bufio.Reader, io.Writer, *Handler) {
+	reader, hWriter := io.Pipe()
+	hReader, writer := io.Pipe()
+	h := NewHandler(server, hReader, hWriter)
+	go writer.Write([]byte("CONNECT\naccept-version:1.2\nheart-beat:" + heartBeat + "\n\n\x00"))
+	return bufio.NewReader(reader), writer, h
+}
+
+func TestHeartBeatSend(t *testing.T) {
+	server := NewServer()
+	server.HeartBeatSend = 20 * time.Millisecond
+	reader, _, h := connectPipe(server, "0,20")
+	defer h.Disconnect()
+
+	fr, err := frame.NewReader(reader).Read()
+	assert.NoError(t, err)
+	assert.Equal(t, frame.CmdConnected, fr.Command)
+	heartBeat, _ := fr.Header.Get(frame.HdrHeartBeat)
+	assert.Equal(t, "20,10000", heartBeat)
+
+	// idle connection receive EOLs
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		b, err := reader.ReadByte()
+		assert.NoError(t, err)
+		assert.Equal(t, byte('\n'), b)
+	}
+	assert.True(t, time.Since(start) < 100*time.Millisecond)
+}
+
+func TestHeartBeatTimeout(t *testing.T) {
+	server := NewServer()
+	server.HeartBeatReceive = 20 * time.Millisecond
+	reader, writer, h := connectPipe(server, "20,0")
+	frameReader := frame.NewReader(reader)
+	fr, err := frameReader.Read()
+	assert.NoError(t, err)
+	assert.Equal(t, frame.CmdConnected, fr.Command)
+
+	go writer.Write([]byte("SUBSCRIBE\nid:1\ndestination:/queue/hb\nreceipt:1\n\n\x00"))
+	fr, err = frameReader.Read()
+	assert.NoError(t, err)
+	assert.Equal(t, frame.CmdReceipt, fr.Command)
+
+	// client keep connection alive with heart-beats
+	for i := 0; i < 5; i++ {
+		time.Sleep(10 * time.Millisecond)
+		writer.Write([]byte("\n"))
+	}
+	assert.False(t, h.closed())
+
+	// and then stop sending anything
+	_, err = frameReader.Read()
+	assert.Equal(t, io.EOF, err)
+	assert.True(t, h.closed())
+	queue := server.GetDispatcher("/queue/hb").(*Queue)
+	queue.lock.Lock()
+	assert.Equal(t, 0, len(queue.Subscriptions))
+	queue.lock.Unlock()
+}
@@ -0,0 +1,66 @@
+package server
+
+import (
+	"errors"
+	"time"
+)
+
+var ErrQueueFull = errors.New("Queue is full")
+
+// What to do with SEND to queue, which backlog reached the limits
+type OverflowPolicy int
+
+const (
+	// wait for consumers up to BlockTimeout, then reject
+	OverflowBlock OverflowPolicy = iota
+	// answer producer with ERROR frame
+	OverflowReject
+	// make room by dropping the oldest pending messages
+	OverflowDropOldest
+)
+
+// Limits of messages, waiting in queue for delivery to consumers.
+// Zero value of MaxMessages or MaxBytes means no limit
+type QueueLimits struct {
+	MaxMessages  int
+	MaxBytes     int
+	Overflow     OverflowPolicy
+	BlockTimeout time.Duration
+}
+
+var DefaultQueueLimits = QueueLimits{
+	MaxMessages:  100000,
+	MaxBytes:     64 * 1024 * 1024,
+	Overflow:     OverflowBlock,
+	BlockTimeout: 5 * time.Second,
+}
+
+// backlog can accept message of given size
+func (l *QueueLimits) fits(messages, bytes int) bool {
+	return (l.MaxMessages == 0 || messages < l.MaxMessages) &&
+		(l.MaxBytes == 0 || bytes <= l.MaxBytes)
+}
+
+// What to do with message for topic subscription, which buffer is full
+type SlowConsumerPolicy int
+
+const (
+	// discard the new message
+	SlowConsumerDropNewest SlowConsumerPolicy = iota
+	// discard the oldest buffered message to make room for the new one
+	SlowConsumerDropOldest
+	// disconnect client of subscription
+	SlowConsumerDisconnect
+)
+
+// Limits of messages, buffered for every topic subscription.
+// Zero value of BufferSize means no limit
+type TopicLimits struct {
+	BufferSize   int
+	SlowConsumer SlowConsumerPolicy
+}
+
+var DefaultTopicLimits = TopicLimits{
+	BufferSize:   1000,
+	SlowConsumer: SlowConsumerDropOldest,
+}
@@ -2,74 +2,675 @@ package server
 
 import (
 	"github.com/galtsev/stomp/frame"
+	"log"
+	"sort"
+	"strconv"
 	"sync"
+	"time"
+)
+
+// range of priority header values, higher priority messages are delivered first
+const (
+	MinPriority     = 0
+	MaxPriority     = 9
+	DefaultPriority = 4
 )
 
 // Implement server.Dispatcher
 type queueSubscription struct {
-	stop chan struct{}
+	id              string
+	ack             string
+	clientWriteChan chan frame.Frame
+	// messages, handed to subscription for writing to client
+	outbox []frame.Frame
+	// wake up writeLoop, when outbox is not empty
+	signal chan struct{}
+	// set while message from outbox is being written to client
+	writing bool
+	// messages, delivered to client and waiting for ACK, in order of delivery
+	unacked []frame.Frame
+	// max number of messages in outbox or, for client ack modes, unacked
+	prefetch int
+	// subscriptions with higher priority receive messages first
+	priority int
+	// share of messages, relative to other subscriptions
+	weight int
+	// grows by 1/weight with every message, subscription with the least
+	// value receive the next message, so that skipped subscriptions catch up
+	vtime float64
+	// only messages, matching selector, are delivered to subscription, nil match all
+	selector *Selector
+	// exclusive subscriptions are standby, while other exclusive one is active
+	exclusive bool
+	stop      chan struct{}
+}
+
+// subscription is ready to receive the next message
+func (sub *queueSubscription) ready() bool {
+	if sub.ack == frame.AckAuto {
+		inFlight := len(sub.outbox)
+		if sub.writing {
+			inFlight++
+		}
+		return inFlight < sub.prefetch
+	}
+	return len(sub.unacked) < sub.prefetch
 }
 
 type Queue struct {
 	Destination   string
-	ch            chan frame.Frame
 	Subscriptions map[string]*queueSubscription
 	lock          sync.Mutex
+	// subscriptions in order of subscribing, for round-robin dispatch
+	order []*queueSubscription
+	next  int
+	// messages, waiting for delivery, by priority and then in order of arrival
+	pending      []frame.Frame
+	pendingBytes int
+	// room in backlog, reserved by prepared messages
+	reserved      int
+	reservedBytes int
+	// closed, when pending message leave the queue
+	space  chan struct{}
+	Limits QueueLimits
+	// after that many NACKs message is moved to DeadLetter,
+	// or dropped, if DeadLetter is nil
+	MaxRedeliveries int
+	DeadLetter      *Queue
+	// keep persistent messages until they are acknowledged, may be nil
+	Store Store
+	// expired messages are moved to ExpiryQueue or dropped, if it is nil
+	ExpiryQueue *Queue
+	expired     int
+	// messages with deliver-at in future, in order of delivery
+	scheduled      []frame.Frame
+	scheduledBytes int
+	timer          *time.Timer
+	// dead and expired messages, which are sent to their queues after q.lock is released
+	moved []movedMessage
+	// subscription, which receive all messages of group, until it is closed
+	groups map[string]*queueSubscription
+	// exclusive subscription, which receive all messages, nil if there is none
+	active *queueSubscription
+}
+
+type movedMessage struct {
+	queue *Queue
+	fr    frame.Frame
 }
 
 func NewQueue(destination string) *Queue {
 	return &Queue{
 		Destination:   destination,
-		ch:            make(chan frame.Frame, 8),
 		Subscriptions: make(map[string]*queueSubscription),
+		groups:        make(map[string]*queueSubscription),
+	}
+}
+
+func (q *Queue) Send(fr frame.Frame) error {
+	if _, ok := fr.Header.Get(frame.HdrMessageId); !ok {
+		fr.Header.Set(frame.HdrMessageId, genId())
+	}
+	if err := q.prepare(fr); err != nil {
+		return err
+	}
+	q.commit(fr)
+	return nil
+}
+
+// save message to Store and reserve room for it in backlog, so that commit
+// can't fail. Message must be either committed or rolled back then
+func (q *Queue) prepare(fr frame.Frame) error {
+	// waiting for disk is done without q.lock, not to stall consumers
+	if q.Store != nil && isPersistent(fr) {
+		if err := q.Store.Append(q.Destination, fr); err != nil {
+			return err
+		}
+	}
+	q.lock.Lock()
+	defer q.unlock()
+	if err := q.makeRoom(len(fr.Body)); err != nil {
+		q.forget(fr)
+		return err
+	}
+	q.reserved++
+	q.reservedBytes += len(fr.Body)
+	return nil
+}
+
+// put prepared message to backlog or schedule
+func (q *Queue) commit(fr frame.Frame) {
+	q.lock.Lock()
+	defer q.unlock()
+	q.reserved--
+	q.reservedBytes -= len(fr.Body)
+	if deliveryTime(fr) > timestamp(time.Now()) {
+		q.schedule(fr)
+		return
+	}
+	q.insert(fr, true)
+	q.dispatch()
+}
+
+// release room, reserved by prepared message, and drop it
+func (q *Queue) rollback(fr frame.Frame) {
+	q.lock.Lock()
+	defer q.unlock()
+	q.reserved--
+	q.reservedBytes -= len(fr.Body)
+	q.forget(fr)
+	q.signalSpace()
+}
+
+// put message, recovered from Store, to the end of queue or to schedule
+func (q *Queue) restore(fr frame.Frame) {
+	q.lock.Lock()
+	defer q.unlock()
+	if deliveryTime(fr) > timestamp(time.Now()) {
+		q.schedule(fr)
+		return
+	}
+	q.insert(fr, true)
+	q.dispatch()
+}
+
+// remove message, which is acknowledged or dropped, from Store
+func (q *Queue) forget(fr frame.Frame) {
+	if q.Store == nil || !isPersistent(fr) {
+		return
+	}
+	msgId, _ := fr.Header.Get(frame.HdrMessageId)
+	if err := q.Store.Remove(q.Destination, msgId); err != nil {
+		log.Println("Failed to remove message from store", q.Destination, err)
+	}
+}
+
+// backlog, including scheduled messages and reserved room, can accept
+// message of given size. Must be called with q.lock held
+func (q *Queue) fits(size int) bool {
+	return q.Limits.fits(len(q.pending)+len(q.scheduled)+q.reserved,
+		q.pendingBytes+q.scheduledBytes+q.reservedBytes+size)
+}
+
+// apply overflow policy, if message of given size don't fit into backlog.
+// Must be called with q.lock held
+func (q *Queue) makeRoom(size int) error {
+	limits := &q.Limits
+	if q.fits(size) {
+		return nil
+	}
+	switch limits.Overflow {
+	case OverflowDropOldest:
+		dropped := 0
+		for len(q.pending) > 0 && !q.fits(size) {
+			// the oldest of messages with the lowest priority
+			lowest := messagePriority(q.pending[len(q.pending)-1])
+			q.forget(q.removePending(q.insertPos(lowest, false)))
+			dropped++
+		}
+		if dropped > 0 {
+			log.Println("Drop", dropped, "oldest messages from", q.Destination)
+		}
+	case OverflowBlock:
+		timer := time.NewTimer(limits.BlockTimeout)
+		defer timer.Stop()
+		for !q.fits(size) && len(q.pending)+len(q.scheduled)+q.reserved > 0 {
+			if q.space == nil {
+				q.space = make(chan struct{})
+			}
+			space := q.space
+			q.lock.Unlock()
+			select {
+			case <-space:
+				q.lock.Lock()
+			case <-timer.C:
+				q.lock.Lock()
+				return ErrQueueFull
+			}
+		}
+	}
+	if !q.fits(size) {
+		return ErrQueueFull
+	}
+	return nil
+}
+
+// remove message from backlog. Must be called with q.lock held
+func (q *Queue) removePending(pos int) frame.Frame {
+	fr := q.pending[pos]
+	if pos == 0 {
+		q.pending = q.pending[1:]
+	} else {
+		q.pending = append(q.pending[:pos], q.pending[pos+1:]...)
+	}
+	q.pendingBytes -= len(fr.Body)
+	q.signalSpace()
+	return fr
+}
+
+// value of priority header, DefaultPriority if it is missing or invalid
+func messagePriority(fr frame.Frame) int {
+	value, ok := fr.Header.Get(frame.HdrPriority)
+	if !ok {
+		return DefaultPriority
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < MinPriority || n > MaxPriority {
+		return DefaultPriority
+	}
+	return n
+}
+
+// position in backlog after all messages with higher priority and,
+// if last is set, after messages with the same priority too.
+// Must be called with q.lock held
+func (q *Queue) insertPos(priority int, last bool) int {
+	return sort.Search(len(q.pending), func(i int) bool {
+		p := messagePriority(q.pending[i])
+		return p < priority || !last && p == priority
+	})
+}
+
+// put message to the tail or, for redelivered messages, to the head
+// of messages with the same priority. Must be called with q.lock held
+func (q *Queue) insert(fr frame.Frame, last bool) {
+	pos := q.insertPos(messagePriority(fr), last)
+	q.pending = append(q.pending, frame.Frame{})
+	copy(q.pending[pos+1:], q.pending[pos:])
+	q.pending[pos] = fr
+	q.pendingBytes += len(fr.Body)
+}
+
+// release q.lock and send moved messages to their queues,
+// so that full dead letter or expiry queue doesn't stall this one
+func (q *Queue) unlock() {
+	moved := q.moved
+	q.moved = nil
+	q.lock.Unlock()
+	for _, m := range moved {
+		if err := m.queue.Send(m.fr); err != nil {
+			log.Println("Drop message, moved to", m.queue.Destination, err)
+		}
+	}
+}
+
+// Must be called with q.lock held
+func (q *Queue) move(queue *Queue, fr frame.Frame) {
+	q.moved = append(q.moved, movedMessage{queue: queue, fr: fr})
+}
+
+// wake up producers, waiting for space in backlog. Must be called with q.lock held
+func (q *Queue) signalSpace() {
+	if q.space != nil {
+		close(q.space)
+		q.space = nil
+	}
+}
+
+// drop expired messages from backlog
+func (q *Queue) Sweep() {
+	q.lock.Lock()
+	defer q.unlock()
+	now := time.Now()
+	var kept []frame.Frame
+	for _, fr := range q.pending {
+		if expired(fr, now) {
+			q.pendingBytes -= len(fr.Body)
+			q.expire(fr)
+		} else {
+			kept = append(kept, fr)
+		}
+	}
+	if len(kept) < len(q.pending) {
+		q.pending = kept
+		q.signalSpace()
+	}
+}
+
+// Must be called with q.lock held
+func (q *Queue) expire(fr frame.Frame) {
+	q.expired++
+	q.forget(fr)
+	if q.ExpiryQueue != nil {
+		q.move(q.ExpiryQueue, expiredMessage(fr, q.Destination, q.ExpiryQueue))
 	}
 }
 
-func (q *Queue) Send(fr frame.Frame) {
-	q.ch <- fr
+// number of messages, expired before delivery
+func (q *Queue) Expired() int {
+	q.lock.Lock()
+	defer q.unlock()
+	return q.expired
 }
 
-func (q *Queue) Subscribe(fr frame.Frame, options SubscriptionOptions) {
+func (q *Queue) Subscribe(fr frame.Frame, options SubscriptionOptions) error {
 	q.lock.Lock()
-	defer q.lock.Unlock()
+	defer q.unlock()
 	subscriptionId, _ := fr.Header.Get(frame.HdrId)
+	if _, ok := q.Subscriptions[subscriptionId]; ok {
+		return ErrDuplicateSubscription
+	}
 	ack, ok := fr.Header.Get(frame.HdrAck)
 	if !ok {
 		ack = frame.AckAuto
 	}
 	sub := queueSubscription{
-		stop: make(chan struct{}, 0),
+		id:              subscriptionId,
+		ack:             ack,
+		prefetch:        intHeader(fr, frame.HdrPrefetchCount, 1),
+		priority:        intHeader(fr, frame.HdrConsumerPriority, 0),
+		weight:          intHeader(fr, frame.HdrConsumerWeight, 1),
+		clientWriteChan: options.ClientWriteChan,
+		signal:          make(chan struct{}, 1),
+		stop:            make(chan struct{}, 0),
+	}
+	if sub.prefetch < 1 {
+		sub.prefetch = 1
+	}
+	if sub.weight < 1 {
+		sub.weight = 1
+	}
+	exclusive, _ := fr.Header.Get(frame.HdrExclusive)
+	sub.exclusive = exclusive == "true"
+	if selector, ok := fr.Header.Get(frame.HdrSelector); ok {
+		var err error
+		if sub.selector, err = ParseSelector(selector); err != nil {
+			return err
+		}
+	}
+	// new subscription don't get messages, already served to others
+	for i, s := range q.order {
+		if i == 0 || s.vtime < sub.vtime {
+			sub.vtime = s.vtime
+		}
 	}
 	q.Subscriptions[subscriptionId] = &sub
-	go func() {
-		var wg sync.WaitGroup
+	q.order = append(q.order, &sub)
+	if sub.exclusive && q.active == nil {
+		q.active = &sub
+	}
+	go q.writeLoop(&sub)
+	q.dispatch()
+	return nil
+}
+
+// value of integer header or default, if header is missing or invalid
+func intHeader(fr frame.Frame, name string, def int) int {
+	value, ok := fr.Header.Get(name)
+	if !ok {
+		return def
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return def
+	}
+	return n
+}
+
+// write messages, handed by dispatch, to client
+func (q *Queue) writeLoop(sub *queueSubscription) {
+	for {
+		select {
+		case <-sub.stop:
+			return
+		case <-sub.signal:
+		}
 		for {
+			q.lock.Lock()
+			if len(sub.outbox) == 0 {
+				q.unlock()
+				break
+			}
+			fr := sub.outbox[0]
+			sub.outbox = sub.outbox[1:]
+			sub.writing = true
+			q.unlock()
 			select {
-			case <-sub.stop:
-				return
-			case fr := <-q.ch:
-				var msgId string
-				if ack != frame.AckAuto {
-					msgId := genId()
-					fr.Header.Set(frame.HdrAck, msgId)
+			case sub.clientWriteChan <- fr:
+				if sub.ack == frame.AckAuto {
+					q.forget(fr)
 				}
-				fr.Header.Set(frame.HdrSubscription, subscriptionId)
-				options.ClientWriteChan <- fr
-				if ack == "client" {
-					wg.Add(1)
-					options.AddAckCallback(msgId, wg.Done)
-					wg.Wait()
+			case <-sub.stop:
+				if sub.ack == frame.AckAuto {
+					// unacked messages of client ack modes are returned by Unsubscribe
+					q.lock.Lock()
+					q.requeue([]frame.Frame{stripDelivery(fr)})
+					q.unlock()
 				}
+				return
+			}
+			q.lock.Lock()
+			sub.writing = false
+			q.dispatch()
+			q.unlock()
+		}
+	}
+}
+
+// choose subscription for message: ready subscription, which selector match message,
+// with the highest priority, and among them the least served one, relative to it's weight.
+// Ties are broken in round-robin order.
+// Message of group goes to subscription, which got the first message of group,
+// or waits until it is ready, so that messages of group are processed in order.
+// While queue has active exclusive subscription, it receive all messages
+func (q *Queue) nextSubscription(fr frame.Frame) *queueSubscription {
+	if sub := q.active; sub != nil {
+		if !sub.ready() || sub.selector != nil && !sub.selector.Matches(fr.Header) {
+			return nil
+		}
+		sub.vtime += 1 / float64(sub.weight)
+		return sub
+	}
+	group, grouped := fr.Header.Get(frame.HdrGroup)
+	if owner, ok := q.groups[group]; grouped && ok {
+		if owner.selector == nil || owner.selector.Matches(fr.Header) {
+			if !owner.ready() {
+				return nil
+			}
+			owner.vtime += 1 / float64(owner.weight)
+			return owner
+		}
+	}
+	var best *queueSubscription
+	bestPos := 0
+	for i := range q.order {
+		pos := (q.next + i) % len(q.order)
+		sub := q.order[pos]
+		if !sub.ready() || sub.selector != nil && !sub.selector.Matches(fr.Header) {
+			continue
+		}
+		if best == nil || sub.priority > best.priority || sub.priority == best.priority && sub.vtime < best.vtime {
+			best, bestPos = sub, pos
+		}
+	}
+	if best == nil {
+		return nil
+	}
+	best.vtime += 1 / float64(best.weight)
+	q.next = bestPos + 1
+	if _, ok := q.groups[group]; grouped && !ok {
+		q.groups[group] = best
+	}
+	return best
+}
+
+// hand pending messages to ready subscriptions. Must be called with q.lock held
+func (q *Queue) dispatch() {
+	now := time.Now()
+	for i := 0; i < len(q.pending); {
+		if expired(q.pending[i], now) {
+			q.expire(q.removePending(i))
+			continue
+		}
+		sub := q.nextSubscription(q.pending[i])
+		if sub == nil {
+			if !q.anyReady() {
+				return
+			}
+			// message doesn't match selectors of ready subscriptions,
+			// it is left for others and the next one is tried
+			i++
+			continue
+		}
+		fr := q.removePending(i)
+		out := fr.Clone()
+		out.Header.Set(frame.HdrSubscription, sub.id)
+		if sub.ack != frame.AckAuto {
+			msgId, _ := fr.Header.Get(frame.HdrMessageId)
+			out.Header.Set(frame.HdrAck, msgId)
+			sub.unacked = append(sub.unacked, fr)
+		}
+		sub.outbox = append(sub.outbox, *out)
+		select {
+		case sub.signal <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// exclusive subscription, which take over from closed active one: the one
+// with the highest priority and, among them, the earliest subscribed.
+// Must be called with q.lock held
+func (q *Queue) standby() *queueSubscription {
+	var next *queueSubscription
+	for _, sub := range q.order {
+		if sub.exclusive && (next == nil || sub.priority > next.priority) {
+			next = sub
+		}
+	}
+	return next
+}
+
+func (q *Queue) anyReady() bool {
+	if q.active != nil {
+		return q.active.ready()
+	}
+	for _, sub := range q.order {
+		if sub.ready() {
+			return true
+		}
+	}
+	return false
+}
+
+// return messages to the head of queue, within their priority
+func (q *Queue) requeue(frames []frame.Frame) {
+	if len(frames) == 0 {
+		return
+	}
+	// in reverse order, so that requeued messages of the same priority keep their order
+	for i := len(frames) - 1; i >= 0; i-- {
+		q.insert(frames[i], false)
+	}
+	q.dispatch()
+}
+
+// remove headers, added to delivered message
+func stripDelivery(fr frame.Frame) frame.Frame {
+	msg := fr.Clone()
+	msg.Header.Del(frame.HdrAck)
+	msg.Header.Del(frame.HdrSubscription)
+	return *msg
+}
+
+func (q *Queue) Ack(subscriptionId, messageId string, ack bool) bool {
+	q.lock.Lock()
+	defer q.unlock()
+	sub, ok := q.Subscriptions[subscriptionId]
+	if !ok {
+		return false
+	}
+	pos := -1
+	for i, fr := range sub.unacked {
+		if id, _ := fr.Header.Get(frame.HdrMessageId); id == messageId {
+			pos = i
+			break
+		}
+	}
+	if pos < 0 {
+		return false
+	}
+	var done []frame.Frame
+	if sub.ack == frame.AckClient {
+		// cumulative acknowledgement of all messages up to this one
+		done = sub.unacked[:pos+1]
+		sub.unacked = append([]frame.Frame(nil), sub.unacked[pos+1:]...)
+	} else {
+		done = []frame.Frame{sub.unacked[pos]}
+		sub.unacked = append(sub.unacked[:pos:pos], sub.unacked[pos+1:]...)
+	}
+	if ack {
+		for _, fr := range done {
+			q.forget(fr)
+		}
+	} else {
+		var redelivered []frame.Frame
+		for _, fr := range done {
+			if msg, ok := q.redelivery(fr); ok {
+				redelivered = append(redelivered, msg)
+			} else {
+				q.forget(fr)
 			}
 		}
-	}()
+		q.requeue(redelivered)
+	}
+	q.dispatch()
+	return true
+}
+
+// prepare NACKed message for redelivery to another consumer.
+// Return false if message exceeded MaxRedeliveries
+func (q *Queue) redelivery(fr frame.Frame) (frame.Frame, bool) {
+	msg := fr.Clone()
+	countHdr, _ := msg.Header.Get(frame.HdrRedeliveryCount)
+	count, _ := strconv.Atoi(countHdr)
+	count++
+	if count > q.MaxRedeliveries {
+		if q.DeadLetter == nil {
+			log.Println("Drop message after", count-1, "redeliveries from", q.Destination)
+			return frame.Frame{}, false
+		}
+		msg.Header.Del(frame.HdrRedeliveryCount)
+		msg.Header.Set(frame.HdrOriginalDestination, q.Destination)
+		msg.Header.Set(frame.HdrDestination, q.DeadLetter.Destination)
+		q.move(q.DeadLetter, *msg)
+		return frame.Frame{}, false
+	}
+	msg.Header.Set(frame.HdrRedeliveryCount, strconv.Itoa(count))
+	return *msg, true
 }
 
 func (q *Queue) Unsubscribe(subscriptionId string) {
 	q.lock.Lock()
-	defer q.lock.Unlock()
+	defer q.unlock()
 	if sub, ok := q.Subscriptions[subscriptionId]; ok {
 		close(sub.stop)
 		delete(q.Subscriptions, subscriptionId)
+		for i, s := range q.order {
+			if s == sub {
+				q.order = append(q.order[:i:i], q.order[i+1:]...)
+				if q.next > i {
+					q.next--
+				}
+				break
+			}
+		}
+		if q.active == sub {
+			q.active = q.standby()
+		}
+		// groups of subscription are assigned to remaining ones with their next messages
+		for group, owner := range q.groups {
+			if owner == sub {
+				delete(q.groups, group)
+			}
+		}
+		// redeliver everything, not acknowledged by this subscription
+		if sub.ack == frame.AckAuto {
+			for _, fr := range sub.outbox {
+				sub.unacked = append(sub.unacked, stripDelivery(fr))
+			}
+		}
+		sub.outbox = nil
+		q.requeue(sub.unacked)
 	}
 }
@@ -3,6 +3,7 @@ package server
 import (
 	"github.com/galtsev/stomp/frame"
 	"github.com/stretchr/testify/assert"
+	"strconv"
 	"testing"
 	"time"
 )
@@ -40,3 +41,465 @@ func TestSubscribeAndSend(t *testing.T) {
 		t.Error("timeout receiving message")
 	}
 }
+
+// headers are name, value pairs of additional SUBSCRIBE headers
+func subscribeQueue(q *Queue, subscriptionId, ack string, headers ...string) chan frame.Frame {
+	subscribeFrame := frame.New()
+	subscribeFrame.Command = frame.CmdSubscribe
+	subscribeFrame.Header.Set(frame.HdrId, subscriptionId)
+	subscribeFrame.Header.Set(frame.HdrAck, ack)
+	for i := 0; i < len(headers); i += 2 {
+		subscribeFrame.Header.Set(headers[i], headers[i+1])
+	}
+	ch := make(chan frame.Frame, 16)
+	q.Subscribe(*subscribeFrame, SubscriptionOptions{ClientWriteChan: ch})
+	return ch
+}
+
+func sendQueue(q *Queue, body string, headers ...string) error {
+	fr := frame.New()
+	fr.Command = frame.CmdMessage
+	fr.Header.Set(frame.HdrDestination, q.Destination)
+	for i := 0; i < len(headers); i += 2 {
+		fr.Header.Set(headers[i], headers[i+1])
+	}
+	fr.Body = []byte(body)
+	return q.Send(*fr)
+}
+
+func expectBody(t *testing.T, ch chan frame.Frame, body string) frame.Frame {
+	select {
+	case fr := <-ch:
+		assert.Equal(t, body, string(fr.Body))
+		return fr
+	case <-time.NewTimer(time.Millisecond * 10).C:
+		t.Fatal("timeout receiving", body)
+	}
+	return frame.Frame{}
+}
+
+func expectNothing(t *testing.T, ch chan frame.Frame) {
+	select {
+	case fr := <-ch:
+		t.Error("unexpected message", string(fr.Body))
+	case <-time.NewTimer(time.Millisecond * 5).C:
+	}
+}
+
+// consumer, which NACK every message
+func subscribeNack(q *Queue, subscriptionId string) chan frame.Frame {
+	ch := subscribeQueue(q, subscriptionId, frame.AckClient)
+	out := make(chan frame.Frame, 16)
+	go func() {
+		for fr := range ch {
+			out <- fr
+			ackId, _ := fr.Header.Get(frame.HdrAck)
+			q.Ack(subscriptionId, ackId, false)
+		}
+	}()
+	return out
+}
+
+func TestClientIndividualAck(t *testing.T) {
+	queue := NewQueue("/queue/individual")
+	ch := subscribeQueue(queue, "sub1", frame.AckClientIndividual)
+	sendQueue(queue, "msg1")
+	sendQueue(queue, "msg2")
+
+	fr := expectBody(t, ch, "msg1")
+	msgId, ok := fr.Header.Get(frame.HdrMessageId)
+	assert.True(t, ok)
+	ackId, _ := fr.Header.Get(frame.HdrAck)
+	assert.Equal(t, msgId, ackId)
+	// next message waits for acknowledgement
+	expectNothing(t, ch)
+	assert.False(t, queue.Ack("sub1", "unknown", true))
+	assert.True(t, queue.Ack("sub1", ackId, true))
+	expectBody(t, ch, "msg2")
+}
+
+func TestClientAckCumulative(t *testing.T) {
+	queue := NewQueue("/queue/cumulative")
+	for _, body := range []string{"msg1", "msg2", "msg3", "msg4"} {
+		sendQueue(queue, body)
+	}
+	ch := subscribeQueue(queue, "sub1", frame.AckClient, frame.HdrPrefetchCount, "3")
+	expectBody(t, ch, "msg1")
+	fr := expectBody(t, ch, "msg2")
+	expectBody(t, ch, "msg3")
+	expectNothing(t, ch)
+
+	// ACK of msg2 acknowledge msg1 too
+	ackId, _ := fr.Header.Get(frame.HdrAck)
+	assert.True(t, queue.Ack("sub1", ackId, true))
+	expectBody(t, ch, "msg4")
+	queue.lock.Lock()
+	assert.Equal(t, 2, len(queue.Subscriptions["sub1"].unacked))
+	queue.lock.Unlock()
+}
+
+func TestPrefetch(t *testing.T) {
+	queue := NewQueue("/queue/prefetch")
+	ch := subscribeQueue(queue, "sub1", frame.AckClientIndividual, frame.HdrPrefetchCount, "2")
+	for _, body := range []string{"msg1", "msg2", "msg3"} {
+		sendQueue(queue, body)
+	}
+	fr1 := expectBody(t, ch, "msg1")
+	expectBody(t, ch, "msg2")
+	// window is full
+	expectNothing(t, ch)
+	ackId, _ := fr1.Header.Get(frame.HdrAck)
+	assert.True(t, queue.Ack("sub1", ackId, true))
+	expectBody(t, ch, "msg3")
+}
+
+func TestRedeliverOnUnsubscribe(t *testing.T) {
+	queue := NewQueue("/queue/redeliver")
+	ch1 := subscribeQueue(queue, "sub1", frame.AckClientIndividual)
+	sendQueue(queue, "msg1")
+	sendQueue(queue, "msg2")
+	expectBody(t, ch1, "msg1")
+
+	ch2 := subscribeQueue(queue, "sub2", frame.AckAuto)
+	expectBody(t, ch2, "msg2")
+	// unacked message goes to another consumer
+	queue.Unsubscribe("sub1")
+	fr := expectBody(t, ch2, "msg1")
+	sId, _ := fr.Header.Get(frame.HdrSubscription)
+	assert.Equal(t, "sub2", sId)
+	_, ok := fr.Header.Get(frame.HdrAck)
+	assert.False(t, ok)
+}
+
+func TestNackDeadLetter(t *testing.T) {
+	queue := NewQueue("/queue/work")
+	queue.MaxRedeliveries = 2
+	queue.DeadLetter = NewQueue("/queue/DLQ.work")
+	nacked := subscribeNack(queue, "sub1")
+	dlq := subscribeQueue(queue.DeadLetter, "dlq", frame.AckAuto)
+	sendQueue(queue, "poison")
+
+	// first delivery and two redeliveries
+	for i := 0; i < 3; i++ {
+		select {
+		case outFr := <-nacked:
+			count, ok := outFr.Header.Get(frame.HdrRedeliveryCount)
+			assert.Equal(t, i > 0, ok)
+			if i > 0 {
+				assert.Equal(t, strconv.Itoa(i), count)
+			}
+		case <-time.NewTimer(time.Millisecond * 10).C:
+			t.Fatal("timeout receiving message")
+		}
+	}
+	select {
+	case outFr := <-dlq:
+		assert.Equal(t, []byte("poison"), outFr.Body)
+		dest, _ := outFr.Header.Get(frame.HdrDestination)
+		assert.Equal(t, "/queue/DLQ.work", dest)
+		orig, _ := outFr.Header.Get(frame.HdrOriginalDestination)
+		assert.Equal(t, "/queue/work", orig)
+	case <-time.NewTimer(time.Millisecond * 10).C:
+		t.Error("timeout receiving message from dead letter queue")
+	}
+}
+
+// competing consumers, equally ready to process messages,
+// must receive messages in turn
+func TestRoundRobin(t *testing.T) {
+	queue := NewQueue("/queue/rr")
+	const consumers, messages = 3, 300
+	chans := make([]chan frame.Frame, consumers)
+	for i := range chans {
+		chans[i] = subscribeQueue(queue, strconv.Itoa(i), frame.AckClientIndividual)
+	}
+	counts := make([]int, consumers)
+	for n := 0; n < messages; n++ {
+		sendQueue(queue, strconv.Itoa(n))
+		var fr frame.Frame
+		select {
+		case fr = <-chans[0]:
+		case fr = <-chans[1]:
+		case fr = <-chans[2]:
+		case <-time.NewTimer(time.Millisecond * 10).C:
+			t.Fatal("timeout receiving message", n)
+		}
+		subId, _ := fr.Header.Get(frame.HdrSubscription)
+		assert.Equal(t, strconv.Itoa(n%consumers), subId)
+		ackId, _ := fr.Header.Get(frame.HdrAck)
+		queue.Ack(subId, ackId, true)
+		i, _ := strconv.Atoi(subId)
+		counts[i]++
+	}
+	for i, count := range counts {
+		assert.Equal(t, messages/consumers, count, "consumer %d", i)
+	}
+}
+
+func TestDispatchOrder(t *testing.T) {
+	queue := NewQueue("/queue/order")
+	// consumers, which don't ack, have enough window for all messages
+	low := subscribeQueue(queue, "low", frame.AckClient, frame.HdrPrefetchCount, "100")
+	heavy := subscribeQueue(queue, "heavy", frame.AckClient, frame.HdrPrefetchCount, "100", frame.HdrConsumerWeight, "2")
+	light := subscribeQueue(queue, "light", frame.AckClient, frame.HdrPrefetchCount, "100")
+	queue.lock.Lock()
+	queue.Subscriptions["low"].priority = -1
+	queue.lock.Unlock()
+
+	for n := 0; n < 9; n++ {
+		sendQueue(queue, strconv.Itoa(n))
+	}
+	for i := 0; i < 6; i++ {
+		<-heavy
+	}
+	for i := 0; i < 3; i++ {
+		<-light
+	}
+	expectNothing(t, heavy)
+	expectNothing(t, light)
+	expectNothing(t, low)
+}
+
+func TestConsumerPriority(t *testing.T) {
+	queue := NewQueue("/queue/priority")
+	backup := subscribeQueue(queue, "backup", frame.AckClientIndividual)
+	main := subscribeQueue(queue, "main", frame.AckClientIndividual, frame.HdrConsumerPriority, "5")
+	sendQueue(queue, "msg1")
+	sendQueue(queue, "msg2")
+	expectBody(t, main, "msg1")
+	// consumer with lower priority receive message, when main consumer is full
+	expectBody(t, backup, "msg2")
+}
+
+func TestOverflowReject(t *testing.T) {
+	q := NewQueue("/queue/test")
+	q.Limits = QueueLimits{MaxMessages: 2, Overflow: OverflowReject}
+	assert.Nil(t, sendQueue(q, "m1"))
+	assert.Nil(t, sendQueue(q, "m2"))
+	assert.Equal(t, ErrQueueFull, sendQueue(q, "m3"))
+	ch := subscribeQueue(q, "s1", frame.AckAuto, frame.HdrPrefetchCount, "16")
+	expectBody(t, ch, "m1")
+	expectBody(t, ch, "m2")
+	expectNothing(t, ch)
+	// backlog is drained by subscription
+	assert.Nil(t, sendQueue(q, "m4"))
+	expectBody(t, ch, "m4")
+}
+
+func TestOverflowMaxBytes(t *testing.T) {
+	q := NewQueue("/queue/test")
+	q.Limits = QueueLimits{MaxBytes: 8, Overflow: OverflowReject}
+	assert.Nil(t, sendQueue(q, "12345"))
+	assert.Equal(t, ErrQueueFull, sendQueue(q, "1234"))
+	assert.Nil(t, sendQueue(q, "123"))
+	assert.Equal(t, ErrQueueFull, sendQueue(q, "1"))
+}
+
+func TestOverflowDropOldest(t *testing.T) {
+	q := NewQueue("/queue/test")
+	q.Limits = QueueLimits{MaxMessages: 2, Overflow: OverflowDropOldest}
+	for i := 1; i <= 4; i++ {
+		assert.Nil(t, sendQueue(q, "m"+strconv.Itoa(i)))
+	}
+	ch := subscribeQueue(q, "s1", frame.AckAuto, frame.HdrPrefetchCount, "16")
+	expectBody(t, ch, "m3")
+	expectBody(t, ch, "m4")
+	expectNothing(t, ch)
+}
+
+func TestOverflowBlock(t *testing.T) {
+	q := NewQueue("/queue/test")
+	q.Limits = QueueLimits{MaxMessages: 1, Overflow: OverflowBlock, BlockTimeout: time.Millisecond * 20}
+	assert.Nil(t, sendQueue(q, "m1"))
+	// nobody consumes - timeout
+	assert.Equal(t, ErrQueueFull, sendQueue(q, "m2"))
+	// producer is released, when consumer takes message from backlog
+	q.Limits.BlockTimeout = time.Second
+	result := make(chan error)
+	go func() {
+		result <- sendQueue(q, "m3")
+	}()
+	time.Sleep(time.Millisecond * 5)
+	ch := subscribeQueue(q, "s1", frame.AckClientIndividual)
+	expectBody(t, ch, "m1")
+	select {
+	case err := <-result:
+		assert.Nil(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("producer is still blocked")
+	}
+}
+
+func TestPriority(t *testing.T) {
+	q := NewQueue("/queue/test")
+	sendQueue(q, "low1", frame.HdrPriority, "1")
+	sendQueue(q, "default1")
+	sendQueue(q, "high1", frame.HdrPriority, "9")
+	sendQueue(q, "low2", frame.HdrPriority, "1")
+	sendQueue(q, "high2", frame.HdrPriority, "9")
+	sendQueue(q, "default2")
+	ch := subscribeQueue(q, "s1", frame.AckClient, frame.HdrPrefetchCount, "16")
+	for _, body := range []string{"high1", "high2", "default1", "default2", "low1", "low2"} {
+		expectBody(t, ch, body)
+	}
+	// redelivered messages go before others of the same priority
+	q.Unsubscribe("s1")
+	sendQueue(q, "high3", frame.HdrPriority, "9")
+	sendQueue(q, "low3", frame.HdrPriority, "1")
+	ch = subscribeQueue(q, "s2", frame.AckAuto, frame.HdrPrefetchCount, "16")
+	for _, body := range []string{"high1", "high2", "high3", "default1", "default2", "low1", "low2", "low3"} {
+		expectBody(t, ch, body)
+	}
+}
+
+func TestPriorityDropOldest(t *testing.T) {
+	q := NewQueue("/queue/test")
+	q.Limits = QueueLimits{MaxMessages: 3, Overflow: OverflowDropOldest}
+	sendQueue(q, "high", frame.HdrPriority, "9")
+	sendQueue(q, "low1", frame.HdrPriority, "1")
+	sendQueue(q, "low2", frame.HdrPriority, "1")
+	sendQueue(q, "mid", frame.HdrPriority, "5")
+	ch := subscribeQueue(q, "s1", frame.AckAuto, frame.HdrPrefetchCount, "16")
+	expectBody(t, ch, "high")
+	expectBody(t, ch, "mid")
+	expectBody(t, ch, "low2")
+	expectNothing(t, ch)
+}
+
+// bodies of all messages, received from ch, by group
+func receiveGroups(ch chan frame.Frame) map[string][]string {
+	groups := make(map[string][]string)
+	for {
+		select {
+		case fr := <-ch:
+			group, _ := fr.Header.Get(frame.HdrGroup)
+			groups[group] = append(groups[group], string(fr.Body))
+		case <-time.After(time.Millisecond * 10):
+			return groups
+		}
+	}
+}
+
+func TestMessageGroups(t *testing.T) {
+	queue := NewQueue("/queue/groups")
+	ch1 := subscribeQueue(queue, "s1", frame.AckClientIndividual, frame.HdrPrefetchCount, "16")
+	ch2 := subscribeQueue(queue, "s2", frame.AckClientIndividual, frame.HdrPrefetchCount, "16")
+	for i := 1; i <= 3; i++ {
+		sendQueue(queue, "a"+strconv.Itoa(i), frame.HdrGroup, "a")
+		sendQueue(queue, "b"+strconv.Itoa(i), frame.HdrGroup, "b")
+		sendQueue(queue, "u"+strconv.Itoa(i))
+	}
+	got1, got2 := receiveGroups(ch1), receiveGroups(ch2)
+	// each group is pinned to it's own subscription, ungrouped messages are balanced
+	if _, ok := got1["a"]; !ok {
+		got1, got2 = got2, got1
+		ch1, ch2 = ch2, ch1
+	}
+	assert.Equal(t, []string{"a1", "a2", "a3"}, got1["a"])
+	assert.Equal(t, []string{"b1", "b2", "b3"}, got2["b"])
+	assert.Equal(t, 0, len(got1["b"])+len(got2["a"]))
+	assert.Equal(t, 3, len(got1[""])+len(got2[""]))
+	assert.NotEqual(t, 0, len(got1[""]))
+	assert.NotEqual(t, 0, len(got2[""]))
+
+	// group of closed subscription moves to the remaining one with unacked messages
+	owner := "s1"
+	if queue.Subscriptions["s1"].clientWriteChan != ch1 {
+		owner = "s2"
+	}
+	queue.Unsubscribe(owner)
+	sendQueue(queue, "a4", frame.HdrGroup, "a")
+	got2 = receiveGroups(ch2)
+	assert.Equal(t, []string{"a1", "a2", "a3", "a4"}, got2["a"])
+}
+
+func TestExclusiveConsumers(t *testing.T) {
+	queue := NewQueue("/queue/exclusive")
+	shared := subscribeQueue(queue, "shared", frame.AckAuto)
+	active := subscribeQueue(queue, "active", frame.AckClientIndividual,
+		frame.HdrExclusive, "true", frame.HdrPrefetchCount, "4")
+	low := subscribeQueue(queue, "low", frame.AckAuto, frame.HdrExclusive, "true")
+	high := subscribeQueue(queue, "high", frame.AckAuto,
+		frame.HdrExclusive, "true", frame.HdrConsumerPriority, "5")
+	sendQueue(queue, "m1")
+	sendQueue(queue, "m2")
+	expectBody(t, active, "m1")
+	expectBody(t, active, "m2")
+	expectNothing(t, shared)
+	expectNothing(t, low)
+	expectNothing(t, high)
+
+	// standby with the highest priority take over and get unacked messages
+	queue.Unsubscribe("active")
+	expectBody(t, high, "m1")
+	expectBody(t, high, "m2")
+	queue.Unsubscribe("high")
+	sendQueue(queue, "m3")
+	expectBody(t, low, "m3")
+	expectNothing(t, shared)
+
+	// without exclusive subscriptions messages go to others
+	queue.Unsubscribe("low")
+	sendQueue(queue, "m4")
+	expectBody(t, shared, "m4")
+}
+
+// full dead letter queue without consumers doesn't stall NACKs
+func TestNackFullDeadLetter(t *testing.T) {
+	server := NewServer()
+	server.MaxRedeliveries = 0
+	server.QueueLimits = QueueLimits{MaxMessages: 1, Overflow: OverflowBlock, BlockTimeout: time.Second}
+	queue := server.GetDispatcher("/queue/work").(*Queue)
+	ch := subscribeQueue(queue, "s1", frame.AckClientIndividual)
+	for _, body := range []string{"m1", "m2", "m3"} {
+		sendQueue(queue, body)
+		fr := expectBody(t, ch, body)
+		msgId, _ := fr.Header.Get(frame.HdrMessageId)
+		start := time.Now()
+		assert.True(t, queue.Ack("s1", msgId, false))
+		assert.True(t, time.Since(start) < 100*time.Millisecond)
+	}
+	dlq := subscribeQueue(queue.DeadLetter, "dlq", frame.AckAuto)
+	expectBody(t, dlq, "m3")
+	expectNothing(t, dlq)
+}
+
+func TestDuplicateSubscription(t *testing.T) {
+	queue := NewQueue("/queue/dup")
+	subscribeQueue(queue, "s1", frame.AckAuto)
+	subscribe := frame.New()
+	subscribe.Command = frame.CmdSubscribe
+	subscribe.Header.Set(frame.HdrId, "s1")
+	err := queue.Subscribe(*subscribe, SubscriptionOptions{ClientWriteChan: make(chan frame.Frame, 1)})
+	assert.Equal(t, ErrDuplicateSubscription, err)
+	assert.Equal(t, 1, len(queue.order))
+}
+
+// group is released, when all it's messages are processed
+// group stays with it's subscription, after all it's messages are acknowledged
+func TestMessageGroupIdleOwner(t *testing.T) {
+	queue := NewQueue("/queue/groups")
+	ch1 := subscribeQueue(queue, "s1", frame.AckClientIndividual, frame.HdrPrefetchCount, "16")
+	ch2 := subscribeQueue(queue, "s2", frame.AckClientIndividual, frame.HdrPrefetchCount, "16")
+	sendQueue(queue, "a1", frame.HdrGroup, "a")
+	var owner, other chan frame.Frame
+	var fr frame.Frame
+	select {
+	case fr = <-ch1:
+		owner, other = ch1, ch2
+	case fr = <-ch2:
+		owner, other = ch2, ch1
+	case <-time.After(time.Second):
+		t.Fatal("message of group is not delivered")
+	}
+	subId, _ := fr.Header.Get(frame.HdrSubscription)
+	id, _ := fr.Header.Get(frame.HdrMessageId)
+	assert.True(t, queue.Ack(subId, id, true))
+	for i := 2; i <= 4; i++ {
+		sendQueue(queue, "a"+strconv.Itoa(i), frame.HdrGroup, "a")
+		fr = expectBody(t, owner, "a"+strconv.Itoa(i))
+		id, _ = fr.Header.Get(frame.HdrMessageId)
+		assert.True(t, queue.Ack(subId, id, true))
+	}
+	expectNothing(t, other)
+}
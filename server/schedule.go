@@ -0,0 +1,122 @@
+package server
+
+import (
+	"errors"
+	"github.com/galtsev/stomp/frame"
+	"sort"
+	"strconv"
+	"time"
+)
+
+var (
+	ErrBadDeliverAt      = errors.New("Bad deliver-at header")
+	ErrBadDelay          = errors.New("Bad delay header")
+	ErrScheduledNonQueue = errors.New("Scheduled delivery is supported only by queues")
+)
+
+// message has deliver-at or delay header
+func isScheduled(fr frame.Frame) bool {
+	_, deliverAt := fr.Header.Get(frame.HdrDeliverAt)
+	_, delay := fr.Header.Get(frame.HdrDelay)
+	return deliverAt || delay
+}
+
+// replace delay header of sent message with absolute deliver-at
+func setSchedule(fr *frame.Frame, now time.Time) error {
+	if deliverAt, ok := fr.Header.Get(frame.HdrDeliverAt); ok {
+		if n, err := strconv.ParseInt(deliverAt, 10, 64); err != nil || n < 0 {
+			return ErrBadDeliverAt
+		}
+	}
+	delay, ok := fr.Header.Get(frame.HdrDelay)
+	if !ok {
+		return nil
+	}
+	n, err := strconv.ParseInt(delay, 10, 64)
+	if err != nil || n < 0 {
+		return ErrBadDelay
+	}
+	fr.Header.Del(frame.HdrDelay)
+	fr.Header.Set(frame.HdrDeliverAt, strconv.FormatInt(timestamp(now)+n, 10))
+	return nil
+}
+
+// value of deliver-at header, 0 if message is delivered immediately
+func deliveryTime(fr frame.Frame) int64 {
+	deliverAt, _ := fr.Header.Get(frame.HdrDeliverAt)
+	n, _ := strconv.ParseInt(deliverAt, 10, 64)
+	return n
+}
+
+// hold message until it's delivery time. Must be called with q.lock held
+func (q *Queue) schedule(fr frame.Frame) {
+	at := deliveryTime(fr)
+	pos := sort.Search(len(q.scheduled), func(i int) bool {
+		return deliveryTime(q.scheduled[i]) > at
+	})
+	q.scheduled = append(q.scheduled, frame.Frame{})
+	copy(q.scheduled[pos+1:], q.scheduled[pos:])
+	q.scheduled[pos] = fr
+	q.scheduledBytes += len(fr.Body)
+	q.armTimer()
+}
+
+// fire timer at delivery time of the first scheduled message.
+// Must be called with q.lock held
+func (q *Queue) armTimer() {
+	if len(q.scheduled) == 0 {
+		if q.timer != nil {
+			q.timer.Stop()
+		}
+		return
+	}
+	delay := time.Duration(deliveryTime(q.scheduled[0])-timestamp(time.Now())) * time.Millisecond
+	if q.timer == nil {
+		q.timer = time.AfterFunc(delay, q.releaseScheduled)
+	} else {
+		q.timer.Reset(delay)
+	}
+}
+
+// move scheduled messages, which delivery time has come, to backlog
+func (q *Queue) releaseScheduled() {
+	q.lock.Lock()
+	defer q.unlock()
+	now := timestamp(time.Now())
+	for len(q.scheduled) > 0 && deliveryTime(q.scheduled[0]) <= now {
+		q.insert(q.scheduled[0], true)
+		q.scheduledBytes -= len(q.scheduled[0].Body)
+		q.scheduled = q.scheduled[1:]
+	}
+	q.armTimer()
+	q.dispatch()
+}
+
+// messages, waiting for their delivery time, in order of delivery
+func (q *Queue) Scheduled() []frame.Frame {
+	q.lock.Lock()
+	defer q.unlock()
+	return append([]frame.Frame(nil), q.scheduled...)
+}
+
+// drop scheduled message. Return false if there is no such message
+func (q *Queue) CancelScheduled(messageId string) bool {
+	q.lock.Lock()
+	defer q.unlock()
+	return q.removeScheduled(messageId)
+}
+
+// Must be called with q.lock held
+func (q *Queue) removeScheduled(messageId string) bool {
+	for i, fr := range q.scheduled {
+		if id, _ := fr.Header.Get(frame.HdrMessageId); id == messageId {
+			q.scheduled = append(q.scheduled[:i:i], q.scheduled[i+1:]...)
+			q.scheduledBytes -= len(fr.Body)
+			q.forget(fr)
+			q.armTimer()
+			q.signalSpace()
+			return true
+		}
+	}
+	return false
+}
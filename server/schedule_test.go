@@ -0,0 +1,99 @@
+package server
+
+import (
+	"github.com/galtsev/stomp/frame"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestSetSchedule(t *testing.T) {
+	now := time.Unix(1000, 0)
+	fr := frame.New()
+	fr.Header.Set(frame.HdrDelay, "500")
+	assert.NoError(t, setSchedule(fr, now))
+	deliverAt, _ := fr.Header.Get(frame.HdrDeliverAt)
+	assert.Equal(t, "1000500", deliverAt)
+	_, ok := fr.Header.Get(frame.HdrDelay)
+	assert.False(t, ok)
+
+	fr = frame.New()
+	fr.Header.Set(frame.HdrDelay, "soon")
+	assert.Equal(t, ErrBadDelay, setSchedule(fr, now))
+	fr = frame.New()
+	fr.Header.Set(frame.HdrDeliverAt, "-5")
+	assert.Equal(t, ErrBadDeliverAt, setSchedule(fr, now))
+}
+
+func TestScheduledDelivery(t *testing.T) {
+	q := NewQueue("/queue/test")
+	ch := subscribeQueue(q, "s1", frame.AckAuto, frame.HdrPrefetchCount, "16")
+	sendQueue(q, "later", frame.HdrMessageId, "1", frame.HdrDeliverAt, millis(time.Now().Add(time.Millisecond*300)))
+	sendQueue(q, "sooner", frame.HdrMessageId, "2", frame.HdrDeliverAt, millis(time.Now().Add(time.Millisecond*30)))
+	sendQueue(q, "past", frame.HdrMessageId, "3", frame.HdrDeliverAt, millis(time.Now().Add(-time.Second)))
+	sendQueue(q, "now")
+	expectBody(t, ch, "past")
+	expectBody(t, ch, "now")
+	expectNothing(t, ch)
+	assert.Equal(t, 2, len(q.Scheduled()))
+	time.Sleep(time.Millisecond * 60)
+	expectBody(t, ch, "sooner")
+	expectNothing(t, ch)
+	time.Sleep(time.Millisecond * 300)
+	expectBody(t, ch, "later")
+	assert.Equal(t, 0, len(q.Scheduled()))
+}
+
+func TestCancelScheduled(t *testing.T) {
+	q := NewQueue("/queue/test")
+	ch := subscribeQueue(q, "s1", frame.AckAuto)
+	sendQueue(q, "cancelled", frame.HdrMessageId, "1", frame.HdrDeliverAt, millis(time.Now().Add(time.Millisecond*20)))
+	sendQueue(q, "kept", frame.HdrMessageId, "2", frame.HdrDeliverAt, millis(time.Now().Add(time.Millisecond*20)))
+	assert.True(t, q.CancelScheduled("1"))
+	assert.False(t, q.CancelScheduled("1"))
+	time.Sleep(time.Millisecond * 30)
+	expectBody(t, ch, "kept")
+	expectNothing(t, ch)
+}
+
+func TestRecoverScheduled(t *testing.T) {
+	dir := t.TempDir()
+	server := NewServer()
+	store, err := NewFileStore(dir, DefaultFileStoreOptions)
+	assert.NoError(t, err)
+	server.Store = store
+	queue := server.GetDispatcher("/queue/test").(*Queue)
+	sendQueue(queue, "m1", frame.HdrPersistent, "true", frame.HdrDeliverAt, millis(time.Now().Add(time.Millisecond*50)))
+	server.Stop()
+
+	server = NewServer()
+	server.Store, err = NewFileStore(dir, DefaultFileStoreOptions)
+	assert.NoError(t, err)
+	assert.NoError(t, server.Recover())
+	queue = server.GetDispatcher("/queue/test").(*Queue)
+	ch := subscribeQueue(queue, "s1", frame.AckAuto)
+	expectNothing(t, ch)
+	time.Sleep(time.Millisecond * 60)
+	expectBody(t, ch, "m1")
+	server.Stop()
+}
+
+func TestScheduledLimits(t *testing.T) {
+	q := NewQueue("/queue/test")
+	q.Limits = QueueLimits{MaxMessages: 2, Overflow: OverflowReject}
+	sendQueue(q, "m1", frame.HdrMessageId, "1", frame.HdrDeliverAt, millis(time.Now().Add(time.Hour)))
+	sendQueue(q, "m2", frame.HdrMessageId, "2", frame.HdrDeliverAt, millis(time.Now().Add(time.Hour)))
+	assert.Equal(t, ErrQueueFull, sendQueue(q, "m3"))
+	assert.True(t, q.CancelScheduled("1"))
+	assert.NoError(t, sendQueue(q, "m3"))
+}
+
+func TestHandlerScheduledTopic(t *testing.T) {
+	server := NewServer()
+	handler := NewHandler(server, nil, nil)
+	send := makeSendFrame("/topic/test", "m1")
+	send.Header.Set(frame.HdrDelay, "100")
+	go handler.Handle(*send)
+	fr := <-handler.outChan
+	assert.Equal(t, frame.CmdError, fr.Command)
+}
@@ -0,0 +1,587 @@
+package server
+
+import (
+	"github.com/galtsev/stomp/frame"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Selector is SQL-92 like boolean expression over message headers, as in
+//
+//	type = 'order' AND (amount > 100 OR region IN ('EU', 'US')) AND NOT name LIKE 'test%'
+//
+// Supported are comparisons =, <>, <, >, <=, >=, [NOT] LIKE with % and _
+// wildcards and optional ESCAPE, [NOT] IN, [NOT] BETWEEN, IS [NOT] NULL,
+// AND, OR, NOT and parentheses. Identifiers are header names, which may contain
+// dashes and dots. Header value is compared as number, when compared to number.
+// Missing header is NULL, and expression with NULL is unknown, as in SQL,
+// so message match only if expression is true
+type Selector struct {
+	source string
+	root   node
+}
+
+type SelectorError struct {
+	Selector string
+	Pos      int
+	Msg      string
+}
+
+func (e SelectorError) Error() string {
+	return "Bad selector at " + strconv.Itoa(e.Pos) + ": " + e.Msg
+}
+
+func ParseSelector(source string) (*Selector, error) {
+	p := selectorParser{source: source}
+	if err := p.tokenize(); err != nil {
+		return nil, err
+	}
+	root, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok.kind != tokEnd {
+		return nil, p.errorAt(tok, "unexpected "+tok.text)
+	}
+	return &Selector{source: source, root: root}, nil
+}
+
+func (s *Selector) String() string {
+	return s.source
+}
+
+func (s *Selector) Matches(header frame.Header) bool {
+	v := s.root.eval(header)
+	return v.kind == valBool && v.b
+}
+
+type valueKind int
+
+const (
+	valNull valueKind = iota
+	valString
+	valNumber
+	valBool
+)
+
+type value struct {
+	kind valueKind
+	s    string
+	n    float64
+	b    bool
+}
+
+var (
+	null      = value{}
+	trueValue = value{kind: valBool, b: true}
+)
+
+func boolValue(b bool) value {
+	return value{kind: valBool, b: b}
+}
+
+// convert string to number for comparison with number
+func (v value) number() (float64, bool) {
+	switch v.kind {
+	case valNumber:
+		return v.n, true
+	case valString:
+		n, err := strconv.ParseFloat(v.s, 64)
+		return n, err == nil
+	}
+	return 0, false
+}
+
+type node interface {
+	eval(header frame.Header) value
+}
+
+type literal struct{ v value }
+
+func (l literal) eval(header frame.Header) value { return l.v }
+
+type identifier struct{ name string }
+
+func (i identifier) eval(header frame.Header) value {
+	if s, ok := header.Get(i.name); ok {
+		return value{kind: valString, s: s}
+	}
+	return null
+}
+
+type andNode struct{ left, right node }
+
+func (n andNode) eval(header frame.Header) value {
+	l := n.left.eval(header)
+	if l.kind == valBool && !l.b {
+		return l
+	}
+	r := n.right.eval(header)
+	if r.kind == valBool && !r.b {
+		return r
+	}
+	if l.kind != valBool || r.kind != valBool {
+		return null
+	}
+	return trueValue
+}
+
+type orNode struct{ left, right node }
+
+func (n orNode) eval(header frame.Header) value {
+	l := n.left.eval(header)
+	if l.kind == valBool && l.b {
+		return l
+	}
+	r := n.right.eval(header)
+	if r.kind == valBool && r.b {
+		return r
+	}
+	if l.kind != valBool || r.kind != valBool {
+		return null
+	}
+	return boolValue(false)
+}
+
+type notNode struct{ operand node }
+
+func (n notNode) eval(header frame.Header) value {
+	v := n.operand.eval(header)
+	if v.kind != valBool {
+		return null
+	}
+	return boolValue(!v.b)
+}
+
+type compareNode struct {
+	op          string
+	left, right node
+}
+
+// compare values as numbers, if one of them is number, or as strings otherwise.
+// Return false, if values are incomparable
+func compare(l, r value) (int, bool) {
+	if l.kind == valNull || r.kind == valNull {
+		return 0, false
+	}
+	if l.kind == valBool || r.kind == valBool {
+		if l.kind != r.kind {
+			return 0, false
+		}
+		if l.b == r.b {
+			return 0, true
+		}
+		return 1, true
+	}
+	if l.kind == valNumber || r.kind == valNumber {
+		ln, lok := l.number()
+		rn, rok := r.number()
+		if !lok || !rok {
+			return 0, false
+		}
+		switch {
+		case ln < rn:
+			return -1, true
+		case ln > rn:
+			return 1, true
+		}
+		return 0, true
+	}
+	return strings.Compare(l.s, r.s), true
+}
+
+func (n compareNode) eval(header frame.Header) value {
+	c, ok := compare(n.left.eval(header), n.right.eval(header))
+	if !ok {
+		return null
+	}
+	switch n.op {
+	case "=":
+		return boolValue(c == 0)
+	case "<>":
+		return boolValue(c != 0)
+	case "<":
+		return boolValue(c < 0)
+	case ">":
+		return boolValue(c > 0)
+	case "<=":
+		return boolValue(c <= 0)
+	default:
+		return boolValue(c >= 0)
+	}
+}
+
+type likeNode struct {
+	operand node
+	pattern *regexp.Regexp
+}
+
+func (n likeNode) eval(header frame.Header) value {
+	v := n.operand.eval(header)
+	if v.kind != valString {
+		return null
+	}
+	return boolValue(n.pattern.MatchString(v.s))
+}
+
+type inNode struct {
+	operand node
+	values  []value
+}
+
+func (n inNode) eval(header frame.Header) value {
+	v := n.operand.eval(header)
+	if v.kind == valNull {
+		return null
+	}
+	for _, item := range n.values {
+		if c, ok := compare(v, item); ok && c == 0 {
+			return trueValue
+		}
+	}
+	return boolValue(false)
+}
+
+type isNullNode struct{ operand node }
+
+func (n isNullNode) eval(header frame.Header) value {
+	return boolValue(n.operand.eval(header).kind == valNull)
+}
+
+type tokenKind int
+
+const (
+	tokEnd tokenKind = iota
+	tokIdent
+	tokKeyword
+	tokString
+	tokNumber
+	tokOp
+)
+
+type token struct {
+	kind tokenKind
+	// upper case for keywords
+	text string
+	pos  int
+}
+
+var keywords = map[string]bool{
+	"AND": true, "OR": true, "NOT": true, "LIKE": true, "ESCAPE": true, "IN": true,
+	"IS": true, "NULL": true, "TRUE": true, "FALSE": true, "BETWEEN": true,
+}
+
+type selectorParser struct {
+	source string
+	tokens []token
+	pos    int
+}
+
+func (p *selectorParser) errorAt(tok token, msg string) error {
+	return SelectorError{Selector: p.source, Pos: tok.pos, Msg: msg}
+}
+
+func isIdentStart(c byte) bool {
+	return c == '_' || c == '$' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func (p *selectorParser) tokenize() error {
+	s := p.source
+	for i := 0; i < len(s); {
+		c := s[i]
+		start := i
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+			continue
+		case isIdentStart(c):
+			for i < len(s) && (isIdentStart(s[i]) || isDigit(s[i]) || s[i] == '-' || s[i] == '.') {
+				i++
+			}
+			word := s[start:i]
+			if upper := strings.ToUpper(word); keywords[upper] {
+				p.tokens = append(p.tokens, token{tokKeyword, upper, start})
+			} else {
+				p.tokens = append(p.tokens, token{tokIdent, word, start})
+			}
+		case isDigit(c) || (c == '-' || c == '+' || c == '.') && i+1 < len(s) && (isDigit(s[i+1]) || s[i+1] == '.'):
+			i++
+			for i < len(s) && (isDigit(s[i]) || s[i] == '.' || s[i] == 'e' || s[i] == 'E') {
+				i++
+			}
+			if _, err := strconv.ParseFloat(s[start:i], 64); err != nil {
+				return SelectorError{p.source, start, "bad number " + s[start:i]}
+			}
+			p.tokens = append(p.tokens, token{tokNumber, s[start:i], start})
+		case c == '\'':
+			// quote inside string is doubled
+			var b strings.Builder
+			i++
+			for {
+				if i >= len(s) {
+					return SelectorError{p.source, start, "unterminated string"}
+				}
+				if s[i] == '\'' {
+					if i+1 < len(s) && s[i+1] == '\'' {
+						b.WriteByte('\'')
+						i += 2
+						continue
+					}
+					i++
+					break
+				}
+				b.WriteByte(s[i])
+				i++
+			}
+			p.tokens = append(p.tokens, token{tokString, b.String(), start})
+		case strings.HasPrefix(s[i:], "<>") || strings.HasPrefix(s[i:], "<=") || strings.HasPrefix(s[i:], ">="):
+			i += 2
+			p.tokens = append(p.tokens, token{tokOp, s[start:i], start})
+		case strings.IndexByte("=<>(),", c) >= 0:
+			i++
+			p.tokens = append(p.tokens, token{tokOp, s[start:i], start})
+		default:
+			return SelectorError{p.source, start, "unexpected character " + string(c)}
+		}
+	}
+	p.tokens = append(p.tokens, token{tokEnd, "end of selector", len(s)})
+	return nil
+}
+
+func (p *selectorParser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *selectorParser) next() token {
+	tok := p.tokens[p.pos]
+	if tok.kind != tokEnd {
+		p.pos++
+	}
+	return tok
+}
+
+// consume token, if it is given keyword or operator
+func (p *selectorParser) accept(text string) bool {
+	tok := p.peek()
+	if (tok.kind == tokKeyword || tok.kind == tokOp) && tok.text == text {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *selectorParser) expect(text string) error {
+	if !p.accept(text) {
+		tok := p.peek()
+		return p.errorAt(tok, "expected "+text+", found "+tok.text)
+	}
+	return nil
+}
+
+func (p *selectorParser) or() (node, error) {
+	left, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("OR") {
+		right, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		left = orNode{left, right}
+	}
+	return left, nil
+}
+
+func (p *selectorParser) and() (node, error) {
+	left, err := p.not()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("AND") {
+		right, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		left = andNode{left, right}
+	}
+	return left, nil
+}
+
+func (p *selectorParser) not() (node, error) {
+	if p.accept("NOT") {
+		operand, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		return notNode{operand}, nil
+	}
+	return p.predicate()
+}
+
+func (p *selectorParser) predicate() (node, error) {
+	left, err := p.operand()
+	if err != nil {
+		return nil, err
+	}
+	tok := p.peek()
+	if tok.kind == tokOp && tok.text != "(" && tok.text != ")" && tok.text != "," {
+		p.next()
+		right, err := p.operand()
+		if err != nil {
+			return nil, err
+		}
+		return compareNode{tok.text, left, right}, nil
+	}
+	if p.accept("IS") {
+		negate := p.accept("NOT")
+		if err := p.expect("NULL"); err != nil {
+			return nil, err
+		}
+		return negateIf(negate, isNullNode{left}), nil
+	}
+	negate := p.accept("NOT")
+	switch {
+	case p.accept("LIKE"):
+		like, err := p.like(left)
+		if err != nil {
+			return nil, err
+		}
+		return negateIf(negate, like), nil
+	case p.accept("IN"):
+		in, err := p.in(left)
+		if err != nil {
+			return nil, err
+		}
+		return negateIf(negate, in), nil
+	case p.accept("BETWEEN"):
+		low, err := p.operand()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect("AND"); err != nil {
+			return nil, err
+		}
+		high, err := p.operand()
+		if err != nil {
+			return nil, err
+		}
+		between := andNode{compareNode{">=", left, low}, compareNode{"<=", left, high}}
+		return negateIf(negate, between), nil
+	case negate:
+		tok := p.peek()
+		return nil, p.errorAt(tok, "expected LIKE, IN or BETWEEN, found "+tok.text)
+	}
+	return left, nil
+}
+
+func negateIf(negate bool, n node) node {
+	if negate {
+		return notNode{n}
+	}
+	return n
+}
+
+func (p *selectorParser) like(operand node) (node, error) {
+	tok := p.next()
+	if tok.kind != tokString {
+		return nil, p.errorAt(tok, "expected pattern string, found "+tok.text)
+	}
+	var escape byte
+	if p.accept("ESCAPE") {
+		esc := p.next()
+		if esc.kind != tokString || len(esc.text) != 1 {
+			return nil, p.errorAt(esc, "expected single character escape string")
+		}
+		escape = esc.text[0]
+	}
+	var expr strings.Builder
+	expr.WriteString("^(?s:")
+	pattern := tok.text
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		switch {
+		case escape != 0 && c == escape && i+1 < len(pattern):
+			i++
+			expr.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		case c == '%':
+			expr.WriteString(".*")
+		case c == '_':
+			expr.WriteString(".")
+		default:
+			expr.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		}
+	}
+	expr.WriteString(")$")
+	re, err := regexp.Compile(expr.String())
+	if err != nil {
+		return nil, p.errorAt(tok, err.Error())
+	}
+	return likeNode{operand, re}, nil
+}
+
+func (p *selectorParser) in(operand node) (node, error) {
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+	n := inNode{operand: operand}
+	for {
+		tok := p.next()
+		lit, ok := literalValue(tok)
+		if !ok {
+			return nil, p.errorAt(tok, "expected literal, found "+tok.text)
+		}
+		n.values = append(n.values, lit)
+		if !p.accept(",") {
+			break
+		}
+	}
+	if err := p.expect(")"); err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+func literalValue(tok token) (value, bool) {
+	switch {
+	case tok.kind == tokString:
+		return value{kind: valString, s: tok.text}, true
+	case tok.kind == tokNumber:
+		n, _ := strconv.ParseFloat(tok.text, 64)
+		return value{kind: valNumber, n: n}, true
+	case tok.kind == tokKeyword && tok.text == "TRUE":
+		return trueValue, true
+	case tok.kind == tokKeyword && tok.text == "FALSE":
+		return boolValue(false), true
+	}
+	return null, false
+}
+
+func (p *selectorParser) operand() (node, error) {
+	if p.accept("(") {
+		n, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+		return n, nil
+	}
+	tok := p.next()
+	if tok.kind == tokIdent {
+		return identifier{tok.text}, nil
+	}
+	if tok.kind == tokKeyword && tok.text == "NULL" {
+		return literal{null}, nil
+	}
+	if v, ok := literalValue(tok); ok {
+		return literal{v}, nil
+	}
+	return nil, p.errorAt(tok, "unexpected "+tok.text)
+}
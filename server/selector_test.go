@@ -0,0 +1,113 @@
+package server
+
+import (
+	"github.com/galtsev/stomp/frame"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestSelector(t *testing.T) {
+	header := frame.NewHeader()
+	header.Set("type", "order")
+	header.Set("amount", "150")
+	header.Set("region", "EU")
+	header.Set("name", "test_1")
+	header.Set("content-type", "text/plain")
+	cases := []struct {
+		selector string
+		match    bool
+	}{
+		{"type = 'order'", true},
+		{"type <> 'order'", false},
+		{"amount > 100", true},
+		{"amount < 100", false},
+		{"amount >= 150 AND amount <= 150", true},
+		{"amount = 150.0", true},
+		{"amount BETWEEN 100 AND 200", true},
+		{"amount NOT BETWEEN 100 AND 200", false},
+		{"region IN ('EU', 'US')", true},
+		{"region NOT IN ('EU', 'US')", false},
+		{"name LIKE 'test%'", true},
+		{"name LIKE 'test!_%' ESCAPE '!'", true},
+		{"name LIKE 'test!__' ESCAPE '!'", true},
+		{"name LIKE 'tes_'", false},
+		{"name NOT LIKE 'prod%'", true},
+		{"content-type = 'text/plain'", true},
+		{"missing IS NULL", true},
+		{"type IS NOT NULL", true},
+		{"missing = 'x'", false},
+		{"NOT missing = 'x'", false},
+		{"missing = 'x' OR type = 'order'", true},
+		{"missing = 'x' AND type = 'order'", false},
+		{"NOT (missing = 'x' AND type = 'bill')", true},
+		{"type = 'order' AND (amount > 1000 OR region = 'EU')", true},
+		{"type = 'order' and not region = 'US'", true},
+		{"type > 5", false},
+	}
+	for _, c := range cases {
+		selector, err := ParseSelector(c.selector)
+		if !assert.NoError(t, err, c.selector) {
+			continue
+		}
+		assert.Equal(t, c.match, selector.Matches(*header), c.selector)
+	}
+}
+
+func TestSelectorErrors(t *testing.T) {
+	for _, s := range []string{
+		"",
+		"type =",
+		"type = 'order",
+		"type = 'order' AND",
+		"(type = 'order'",
+		"region IN ()",
+		"name NOT 'x'",
+		"name LIKE x",
+		"type # 1",
+	} {
+		_, err := ParseSelector(s)
+		_, ok := err.(SelectorError)
+		assert.True(t, ok, s)
+	}
+}
+
+func subscribeSelector(q *Queue, subscriptionId, selector string) chan frame.Frame {
+	return subscribeQueue(q, subscriptionId, frame.AckAuto, frame.HdrSelector, selector, frame.HdrPrefetchCount, "16")
+}
+
+func TestQueueSelector(t *testing.T) {
+	q := NewQueue("/queue/test")
+	orders := subscribeSelector(q, "s1", "type = 'order'")
+	sendQueue(q, "bill1", "type", "bill")
+	sendQueue(q, "order1", "type", "order")
+	expectBody(t, orders, "order1")
+	expectNothing(t, orders)
+	// non-matching message waited for other consumer
+	bills := subscribeSelector(q, "s2", "type = 'bill'")
+	expectBody(t, bills, "bill1")
+	sendQueue(q, "order2", "type", "order")
+	expectBody(t, orders, "order2")
+	expectNothing(t, bills)
+
+	sub := frame.New()
+	sub.Header.Set(frame.HdrId, "s3")
+	sub.Header.Set(frame.HdrSelector, "type = ")
+	assert.Error(t, q.Subscribe(*sub, SubscriptionOptions{ClientWriteChan: make(chan frame.Frame)}))
+}
+
+func TestTopicSelector(t *testing.T) {
+	topic := NewTopic("/topic/test")
+	all := make(chan frame.Frame, 4)
+	orders := make(chan frame.Frame, 4)
+	subscribeTopic(topic, "s1", all, nil)
+	fr := frame.New()
+	fr.Header.Set(frame.HdrId, "s2")
+	fr.Header.Set(frame.HdrSelector, "type = 'order'")
+	assert.NoError(t, topic.Subscribe(*fr, SubscriptionOptions{ClientWriteChan: orders}))
+	sendTopic(topic, "bill1", "type", "bill")
+	sendTopic(topic, "order1", "type", "order")
+	expectBody(t, all, "bill1")
+	expectBody(t, all, "order1")
+	expectBody(t, orders, "order1")
+	expectNothing(t, orders)
+}
@@ -1,19 +1,59 @@
 package server
 
 import (
+	"errors"
+	"github.com/galtsev/stomp/frame"
 	"io"
 	"log"
 	"net"
 	"strings"
 	"sync"
+	"time"
+)
+
+const (
+	DefaultHeartBeat        = 10 * time.Second
+	DefaultMaxRedeliveries  = 5
+	DefaultDeadLetterPrefix = "/queue/DLQ."
+	DefaultCloseTimeout     = 5 * time.Second
 )
 
 type Server struct {
 	Dispatchers map[string]Dispatcher
 	Handlers    map[string]*Handler
-	listener    net.Listener
-	hLock       sync.Mutex
-	dispLock    sync.RWMutex
+	// limits for frames, received from clients
+	ReaderOptions frame.ReaderOptions
+	// heart-beat intervals, offered to clients. Zero disable heart-beats
+	HeartBeatSend    time.Duration
+	HeartBeatReceive time.Duration
+	// how long disconnected client is given to receive the last frames,
+	// before it's connection is closed
+	CloseTimeout time.Duration
+	// check credentials of connecting clients, nil allow everyone.
+	// Durable subscriptions of unauthenticated clients are shared by client-id
+	Authenticator Authenticator
+	// check permissions of clients on destinations, nil allow everything
+	Authorizer Authorizer
+	// NACKed message is redelivered at most MaxRedeliveries times,
+	// and then moved to queue with DeadLetterPrefix prepended to queue name
+	MaxRedeliveries  int
+	DeadLetterPrefix string
+	// limits of backlog of every queue
+	QueueLimits QueueLimits
+	// limits of messages, buffered for topic subscription
+	TopicLimits TopicLimits
+	// keep persistent messages of queues, nil keep everything in memory only
+	Store Store
+	// queue for expired messages, empty to drop them
+	ExpiryQueue string
+	// how often backlogs of queues are checked for expired messages
+	ExpirySweepInterval time.Duration
+	stop                chan struct{}
+	// wildcard topics, receiving messages of matching topics
+	wildcards *topicIndex
+	listener  net.Listener
+	hLock     sync.Mutex
+	dispLock  sync.RWMutex
 	// temporary hook for testing
 	// send message to this channel when listener is ready
 	NotifyChan chan struct{}
@@ -21,8 +61,19 @@ type Server struct {
 
 func NewServer() *Server {
 	return &Server{
-		Dispatchers: make(map[string]Dispatcher),
-		Handlers:    make(map[string]*Handler),
+		Dispatchers:         make(map[string]Dispatcher),
+		Handlers:            make(map[string]*Handler),
+		ReaderOptions:       frame.DefaultReaderOptions,
+		HeartBeatSend:       DefaultHeartBeat,
+		HeartBeatReceive:    DefaultHeartBeat,
+		CloseTimeout:        DefaultCloseTimeout,
+		MaxRedeliveries:     DefaultMaxRedeliveries,
+		DeadLetterPrefix:    DefaultDeadLetterPrefix,
+		QueueLimits:         DefaultQueueLimits,
+		TopicLimits:         DefaultTopicLimits,
+		ExpirySweepInterval: DefaultExpirySweepInterval,
+		stop:                make(chan struct{}),
+		wildcards:           newTopicIndex(),
 	}
 }
 
@@ -40,7 +91,33 @@ func (s *Server) RemoveHandler(h *Handler) {
 	s.hLock.Unlock()
 }
 
+// load messages, saved in Store by previous run of server, to their queues
+func (s *Server) Recover() error {
+	if s.Store == nil {
+		return nil
+	}
+	recovered := 0
+	err := s.Store.Iterate(func(destination string, fr frame.Frame) {
+		if isTempQueue(destination) {
+			// connection, which owned temporary queue, is closed
+			msgId, _ := fr.Header.Get(frame.HdrMessageId)
+			s.Store.Remove(destination, msgId)
+			return
+		}
+		if queue, ok := s.GetDispatcher(destination).(*Queue); ok {
+			queue.restore(fr)
+			recovered++
+		}
+	})
+	log.Println("Recovered", recovered, "messages")
+	return err
+}
+
 func (s *Server) ListenAndServe(addr string) {
+	if err := s.Recover(); err != nil {
+		log.Panic(err)
+	}
+	go s.sweepLoop()
 	listener, err := net.Listen("tcp", addr)
 
 	if err != nil {
@@ -71,15 +148,32 @@ func (s *Server) Connect() *net.Conn {
 }
 
 func (s *Server) Stop() {
+	select {
+	case <-s.stop:
+	default:
+		close(s.stop)
+	}
 	if s.listener != nil {
 		err := s.listener.Close()
 		if err != nil {
 			log.Println("Error closing ")
 		}
 	}
+	// handlers remove themselves from s.Handlers on disconnect
+	s.hLock.Lock()
+	handlers := make([]*Handler, 0, len(s.Handlers))
 	for _, handler := range s.Handlers {
+		handlers = append(handlers, handler)
+	}
+	s.hLock.Unlock()
+	for _, handler := range handlers {
 		handler.Disconnect()
 	}
+	if s.Store != nil {
+		if err := s.Store.Close(); err != nil {
+			log.Println("Error closing store", err)
+		}
+	}
 }
 
 func (s *Server) GetDispatcher(destination string) Dispatcher {
@@ -92,10 +186,18 @@ func (s *Server) GetDispatcher(destination string) Dispatcher {
 		s.dispLock.Lock()
 		dispatcher, ok = s.Dispatchers[destination]
 		if !ok {
-			if strings.HasPrefix(destination, "/queue") {
-				dispatcher = NewQueue(destination)
+			if isQueue(destination) {
+				dispatcher = s.newQueue(destination)
 			} else {
-				dispatcher = NewTopic(destination)
+				topic := NewTopic(destination)
+				topic.Limits = s.TopicLimits
+				topic.ExpiryQueue = s.expiryQueue(destination)
+				if isWildcard(destination) {
+					s.wildcards.add(topic)
+				} else {
+					topic.wildcards = s.wildcards
+				}
+				dispatcher = topic
 			}
 			s.Dispatchers[destination] = dispatcher
 		}
@@ -103,3 +205,173 @@ func (s *Server) GetDispatcher(destination string) Dispatcher {
 	}
 	return dispatcher
 }
+
+// existing dispatcher of destination, which is not created if it is missing
+func (s *Server) findDispatcher(destination string) (Dispatcher, bool) {
+	s.dispLock.RLock()
+	defer s.dispLock.RUnlock()
+	dispatcher, ok := s.Dispatchers[destination]
+	return dispatcher, ok
+}
+
+func isQueue(destination string) bool {
+	return strings.HasPrefix(destination, "/queue")
+}
+
+func (s *Server) newQueue(destination string) *Queue {
+	queue := NewQueue(destination)
+	queue.MaxRedeliveries = s.MaxRedeliveries
+	queue.Limits = s.QueueLimits
+	if destination == s.ExpiryQueue || strings.HasPrefix(destination, s.DeadLetterPrefix) {
+		// such queues usually have no consumers, so that they would block
+		// every redelivery or expiration, when they are full
+		queue.Limits.Overflow = OverflowDropOldest
+	}
+	queue.Store = s.Store
+	queue.ExpiryQueue = s.expiryQueue(destination)
+	if !strings.HasPrefix(destination, s.DeadLetterPrefix) && !isTempQueue(destination) {
+		// dead letter queue itself just drop messages,
+		// and temporary queue doesn't leave anything after deletion
+		name := s.DeadLetterPrefix + strings.TrimPrefix(destination, "/queue/")
+		if dlq, ok := s.Dispatchers[name]; ok {
+			queue.DeadLetter = dlq.(*Queue)
+		} else {
+			queue.DeadLetter = s.newQueue(name)
+			s.Dispatchers[name] = queue.DeadLetter
+		}
+	}
+	return queue
+}
+
+// queue for expired messages of destination, nil if they are dropped.
+// Must be called with s.dispLock held
+func (s *Server) expiryQueue(destination string) *Queue {
+	if s.ExpiryQueue == "" || destination == s.ExpiryQueue || strings.HasPrefix(destination, s.DeadLetterPrefix) {
+		// dead letter queues don't move messages further, not to make loops
+		return nil
+	}
+	if dispatcher, ok := s.Dispatchers[s.ExpiryQueue]; ok {
+		queue, _ := dispatcher.(*Queue)
+		return queue
+	}
+	queue := s.newQueue(s.ExpiryQueue)
+	s.Dispatchers[s.ExpiryQueue] = queue
+	return queue
+}
+
+// periodically drop expired messages from backlogs of queues
+func (s *Server) sweepLoop() {
+	ticker := time.NewTicker(s.ExpirySweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+		}
+		var queues []*Queue
+		s.dispLock.RLock()
+		for _, dispatcher := range s.Dispatchers {
+			if queue, ok := dispatcher.(*Queue); ok {
+				queues = append(queues, queue)
+			}
+		}
+		s.dispLock.RUnlock()
+		for _, queue := range queues {
+			queue.Sweep()
+		}
+	}
+}
+
+// split composite destination, which is comma separated list of destinations
+func splitDestinations(destination string) ([]string, error) {
+	var destinations []string
+	seen := make(map[string]bool)
+	for _, d := range strings.Split(destination, ",") {
+		d = strings.TrimSpace(d)
+		if d == "" {
+			return nil, errors.New("Empty destination in " + destination)
+		}
+		if !seen[d] {
+			seen[d] = true
+			destinations = append(destinations, d)
+		}
+	}
+	return destinations, nil
+}
+
+// Send deliver message to all destinations or, if one of queues doesn't
+// accept message, to none of them. Every copy of message gets new message-id
+func (s *Server) Send(destinations []string, fr frame.Frame) error {
+	d, err := s.prepareSend(destinations, fr)
+	if err != nil {
+		return err
+	}
+	d.commit()
+	return nil
+}
+
+// copy of message for one of destinations
+type target struct {
+	dispatcher Dispatcher
+	fr         frame.Frame
+}
+
+// message, prepared for delivery to it's destinations
+type delivery []target
+
+// reserve room for message in all queues. Topics always accept messages,
+// so they get message on commit.
+// Message to temporary queue, which owner is disconnected, is dropped,
+// usually it is reply, which nobody is waiting for anymore
+func (s *Server) prepareSend(destinations []string, fr frame.Frame) (delivery, error) {
+	var d delivery
+	for _, destination := range destinations {
+		dispatcher, err := s.lookupDispatcher(destination)
+		if err == ErrUnknownTempQueue {
+			log.Println("Drop message to", destination, err)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		msg := fr.Clone()
+		if len(destinations) > 1 {
+			msg.Header.Set(frame.HdrDestination, destination)
+		}
+		msg.Header.Set(frame.HdrMessageId, genId())
+		d = append(d, target{dispatcher: dispatcher, fr: *msg})
+	}
+	for i, t := range d {
+		queue, ok := t.dispatcher.(*Queue)
+		if !ok {
+			continue
+		}
+		if err := queue.prepare(t.fr); err != nil {
+			d[:i].rollback()
+			if len(destinations) > 1 {
+				err = errors.New(err.Error() + ": " + queue.Destination)
+			}
+			return nil, err
+		}
+	}
+	return d, nil
+}
+
+func (d delivery) commit() {
+	for _, t := range d {
+		if queue, ok := t.dispatcher.(*Queue); ok {
+			queue.commit(t.fr)
+		} else if err := t.dispatcher.Send(t.fr); err != nil {
+			log.Println("Failed to deliver message", err)
+		}
+	}
+}
+
+func (d delivery) rollback() {
+	for _, t := range d {
+		if queue, ok := t.dispatcher.(*Queue); ok {
+			queue.rollback(t.fr)
+		}
+	}
+}
@@ -0,0 +1,23 @@
+package server
+
+import (
+	"github.com/galtsev/stomp/frame"
+)
+
+// Store keep persistent messages of queues, so that they survive restart of server
+type Store interface {
+	// save message, sent to destination. Message is durable, when Append return
+	Append(destination string, fr frame.Frame) error
+	// message is acknowledged or dropped and must not be recovered
+	Remove(destination, messageId string) error
+	// call fn for every message, which is not removed, in order of appending.
+	// Intended for recovery, before messages are appended
+	Iterate(fn func(destination string, fr frame.Frame)) error
+	Close() error
+}
+
+// only messages, sent with persistent:true header, are saved to Store
+func isPersistent(fr frame.Frame) bool {
+	value, _ := fr.Header.Get(frame.HdrPersistent)
+	return value == "true"
+}
@@ -0,0 +1,98 @@
+package server
+
+import (
+	"errors"
+	"strings"
+)
+
+var (
+	ErrUnknownTempQueue = errors.New("Unknown temporary queue")
+	ErrForeignTempQueue = errors.New("Temporary queue belong to other connection")
+)
+
+const (
+	// prefix of temporary queue, as used by client, which created it
+	TempQueuePrefix = "/temp-queue/"
+	// prefix of server side name of temporary queue, which is used by other clients
+	tempQueueName = "/queue/temp."
+)
+
+func isTempQueue(destination string) bool {
+	return strings.HasPrefix(destination, tempQueueName)
+}
+
+// replace temporary queue name of client with unique server side name,
+// creating queue on first use
+func (h *Handler) resolve(destination string) string {
+	if !strings.HasPrefix(destination, TempQueuePrefix) {
+		return destination
+	}
+	name := tempQueueName + h.id + "." + strings.TrimPrefix(destination, TempQueuePrefix)
+	if !h.tempQueues[name] {
+		h.Server.createTempQueue(name)
+		h.tempQueues[name] = true
+	}
+	return name
+}
+
+func (s *Server) createTempQueue(name string) *Queue {
+	s.dispLock.Lock()
+	defer s.dispLock.Unlock()
+	queue := s.newQueue(name)
+	s.Dispatchers[name] = queue
+	return queue
+}
+
+// remove queue with all it's messages
+func (s *Server) deleteQueue(name string) {
+	s.dispLock.Lock()
+	dispatcher := s.Dispatchers[name]
+	delete(s.Dispatchers, name)
+	s.dispLock.Unlock()
+	if queue, ok := dispatcher.(*Queue); ok {
+		queue.destroy()
+	}
+}
+
+// dispatcher of destination. Unlike GetDispatcher, don't create temporary queues,
+// which exist only while their connection is open
+func (s *Server) lookupDispatcher(destination string) (Dispatcher, error) {
+	if isTempQueue(destination) {
+		dispatcher, ok := s.findDispatcher(destination)
+		if !ok {
+			return nil, ErrUnknownTempQueue
+		}
+		return dispatcher, nil
+	}
+	return s.GetDispatcher(destination), nil
+}
+
+// drop all messages of queue, which is deleted
+func (q *Queue) destroy() {
+	q.lock.Lock()
+	defer q.unlock()
+	for _, sub := range q.Subscriptions {
+		close(sub.stop)
+		for _, fr := range sub.outbox {
+			q.forget(fr)
+		}
+		for _, fr := range sub.unacked {
+			q.forget(fr)
+		}
+	}
+	q.Subscriptions = make(map[string]*queueSubscription)
+	q.order = nil
+	q.next = 0
+	q.groups = make(map[string]*queueSubscription)
+	q.active = nil
+	for _, fr := range q.pending {
+		q.forget(fr)
+	}
+	for _, fr := range q.scheduled {
+		q.forget(fr)
+	}
+	q.pending, q.scheduled = nil, nil
+	q.pendingBytes, q.scheduledBytes = 0, 0
+	q.armTimer()
+	q.signalSpace()
+}
@@ -1,39 +1,285 @@
 package server
 
 import (
+	"errors"
 	"github.com/galtsev/stomp/frame"
+	"log"
+	"sync"
+	"time"
+)
+
+var (
+	ErrMissingClientId  = errors.New("Durable subscription require client-id")
+	ErrDurableSubActive = errors.New("Durable subscription is already active")
 )
 
 type topicSubscription struct {
+	id              string
 	clientWriteChan chan frame.Frame
+	// messages, waiting for writing to client
+	buffer []frame.Frame
+	// wake up writeLoop, when buffer is not empty
+	signal chan struct{}
+	stop   chan struct{}
+	// called once, when subscription falls behind with SlowConsumerDisconnect policy
+	disconnect func()
+	slow       bool
+	dropped    int
+	// key of durable subscription, empty for regular one
+	durable string
+	// durable subscription without connected client
+	offline bool
+	// only messages, matching selector, are delivered to subscription, nil match all
+	selector *Selector
 }
 
 type Topic struct {
+	Destination string
+	// active subscriptions by subscription id
 	Subscribers map[string]*topicSubscription
+	// durable subscriptions, active or offline, by client-id and subscription name
+	durables map[string]*topicSubscription
+	Limits   TopicLimits
+	lock     sync.Mutex
+	// messages, dropped for all subscriptions, including unsubscribed
+	dropped int
+	// expired messages are moved to ExpiryQueue or dropped, if it is nil
+	ExpiryQueue *Queue
+	expired     int
+	// messages are delivered to matching wildcard topics of index too,
+	// nil for wildcard topic itself
+	wildcards *topicIndex
 }
 
 func NewTopic(destination string) *Topic {
 	return &Topic{
+		Destination: destination,
 		Subscribers: make(map[string]*topicSubscription),
+		durables:    make(map[string]*topicSubscription),
 	}
 }
 
-func (t *Topic) Send(fr frame.Frame) {
+func durableKey(clientId, name string) string {
+	return clientId + "/" + name
+}
+
+func (t *Topic) Send(fr frame.Frame) error {
+	t.deliver(fr)
+	if t.wildcards != nil {
+		for _, wildcard := range t.wildcards.match(t.Destination) {
+			wildcard.deliver(fr)
+		}
+	}
+	return nil
+}
+
+// push message to buffers of all subscriptions of topic
+func (t *Topic) deliver(fr frame.Frame) {
+	if expired(fr, time.Now()) {
+		t.expire(fr)
+		return
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
 	for _, sub := range t.Subscribers {
-		sub.clientWriteChan <- fr
+		t.push(sub, fr)
+	}
+	for _, sub := range t.durables {
+		if sub.offline {
+			t.push(sub, fr)
+		}
 	}
 }
 
-func (t *Topic) Subscribe(fr frame.Frame, options SubscriptionOptions) {
+// add message to subscription buffer, applying slow consumer policy.
+// Must be called with t.lock held
+func (t *Topic) push(sub *topicSubscription, fr frame.Frame) {
+	if sub.selector != nil && !sub.selector.Matches(fr.Header) {
+		return
+	}
+	if t.Limits.BufferSize > 0 && len(sub.buffer) >= t.Limits.BufferSize {
+		sub.dropped++
+		t.dropped++
+		switch t.Limits.SlowConsumer {
+		case SlowConsumerDropNewest:
+			return
+		case SlowConsumerDropOldest:
+			sub.buffer = sub.buffer[1:]
+		case SlowConsumerDisconnect:
+			// offline subscription has nobody to disconnect, so just keep the oldest messages
+			if !sub.slow && !sub.offline {
+				sub.slow = true
+				log.Println("Slow consumer", sub.id, "of", t.Destination)
+				if sub.disconnect != nil {
+					// disconnect unsubscribe, which need t.lock
+					go sub.disconnect()
+				}
+			}
+			return
+		}
+	}
+	sub.buffer = append(sub.buffer, fr)
+	select {
+	case sub.signal <- struct{}{}:
+	default:
+	}
+}
+
+// SUBSCRIBE with subscription-name header create durable subscription or,
+// if it already exists, deliver messages, accumulated while client was offline
+func (t *Topic) Subscribe(fr frame.Frame, options SubscriptionOptions) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
 	subscriptionId, _ := fr.Header.Get(frame.HdrId)
-	sub := topicSubscription{
-		clientWriteChan: options.ClientWriteChan,
+	name, durable := fr.Header.Get(frame.HdrSubscriptionName)
+	if durable && options.ClientId == "" {
+		return ErrMissingClientId
+	}
+	var selector *Selector
+	if value, ok := fr.Header.Get(frame.HdrSelector); ok {
+		var err error
+		if selector, err = ParseSelector(value); err != nil {
+			return err
+		}
+	}
+	var sub *topicSubscription
+	if durable {
+		key := durableKey(options.ClientId, name)
+		if sub = t.durables[key]; sub == nil {
+			sub = &topicSubscription{durable: key}
+			t.durables[key] = sub
+		} else if !sub.offline {
+			return ErrDurableSubActive
+		}
+	} else {
+		sub = &topicSubscription{}
+	}
+	sub.id = subscriptionId
+	sub.selector = selector
+	sub.clientWriteChan = options.ClientWriteChan
+	sub.disconnect = options.Disconnect
+	sub.signal = make(chan struct{}, 1)
+	sub.stop = make(chan struct{})
+	sub.slow = false
+	sub.offline = false
+	if len(sub.buffer) > 0 {
+		sub.signal <- struct{}{}
+	}
+	t.Subscribers[subscriptionId] = sub
+	// fields of durable subscription are replaced with every connection
+	go t.writeLoop(sub, sub.clientWriteChan, sub.signal, sub.stop)
+	return nil
+}
+
+// write buffered messages to client
+func (t *Topic) writeLoop(sub *topicSubscription, clientWriteChan chan frame.Frame, signal, stop chan struct{}) {
+	for {
+		select {
+		case <-stop:
+			return
+		case <-signal:
+		}
+		for {
+			t.lock.Lock()
+			if len(sub.buffer) == 0 {
+				t.lock.Unlock()
+				break
+			}
+			fr := sub.buffer[0]
+			sub.buffer = sub.buffer[1:]
+			if expired(fr, time.Now()) {
+				t.lock.Unlock()
+				t.expire(fr)
+				continue
+			}
+			// subscription id of durable subscription change with reconnect
+			out := fr.Clone()
+			out.Header.Set(frame.HdrSubscription, sub.id)
+			t.lock.Unlock()
+			select {
+			case clientWriteChan <- *out:
+			case <-stop:
+				if sub.durable != "" {
+					// keep message for the next connection of client
+					t.lock.Lock()
+					sub.buffer = append([]frame.Frame{fr}, sub.buffer...)
+					t.lock.Unlock()
+				}
+				return
+			}
+		}
 	}
-	t.Subscribers[subscriptionId] = &sub
 }
 
+// durable subscription is kept and accumulate messages until removed by RemoveDurable
 func (t *Topic) Unsubscribe(subscriptionId string) {
-	if _, ok := t.Subscribers[subscriptionId]; ok {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if sub, ok := t.Subscribers[subscriptionId]; ok {
+		close(sub.stop)
 		delete(t.Subscribers, subscriptionId)
+		sub.offline = true
+		sub.clientWriteChan = nil
+		sub.disconnect = nil
+	}
+}
+
+// remove durable subscription with it's accumulated messages.
+// Return false if there is no such subscription
+func (t *Topic) RemoveDurable(clientId, name string) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	key := durableKey(clientId, name)
+	sub, ok := t.durables[key]
+	if !ok {
+		return false
+	}
+	delete(t.durables, key)
+	if !sub.offline {
+		close(sub.stop)
+		delete(t.Subscribers, sub.id)
+	}
+	sub.buffer = nil
+	return true
+}
+
+// messages of topic are not redelivered, so acknowledgement is meaningless
+func (t *Topic) Ack(subscriptionId, messageId string, ack bool) bool {
+	return false
+}
+
+// Must be called without t.lock held, not to wait for ExpiryQueue with it
+func (t *Topic) expire(fr frame.Frame) {
+	t.lock.Lock()
+	t.expired++
+	t.lock.Unlock()
+	if t.ExpiryQueue != nil {
+		if err := t.ExpiryQueue.Send(expiredMessage(fr, t.Destination, t.ExpiryQueue)); err != nil {
+			log.Println("Drop expired message, moved to", t.ExpiryQueue.Destination, err)
+		}
 	}
 }
+
+// number of messages, expired before delivery to subscription
+func (t *Topic) Expired() int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.expired
+}
+
+// number of messages, dropped for subscription by slow consumer policy
+func (t *Topic) Dropped(subscriptionId string) int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if sub, ok := t.Subscribers[subscriptionId]; ok {
+		return sub.dropped
+	}
+	return 0
+}
+
+// number of messages, dropped for all subscriptions of topic
+func (t *Topic) TotalDropped() int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.dropped
+}
@@ -0,0 +1,143 @@
+package server
+
+import (
+	"github.com/galtsev/stomp/frame"
+	"github.com/stretchr/testify/assert"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func subscribeTopic(topic *Topic, subscriptionId string, ch chan frame.Frame, disconnect func()) {
+	subscribeFrame := frame.New()
+	subscribeFrame.Command = frame.CmdSubscribe
+	subscribeFrame.Header.Set(frame.HdrId, subscriptionId)
+	topic.Subscribe(*subscribeFrame, SubscriptionOptions{ClientWriteChan: ch, Disconnect: disconnect})
+}
+
+func sendTopic(topic *Topic, body string, headers ...string) {
+	fr := frame.New()
+	fr.Command = frame.CmdMessage
+	fr.Header.Set(frame.HdrDestination, topic.Destination)
+	for i := 0; i < len(headers); i += 2 {
+		fr.Header.Set(headers[i], headers[i+1])
+	}
+	fr.Body = []byte(body)
+	topic.Send(*fr)
+}
+
+func TestTopicFanOut(t *testing.T) {
+	topic := NewTopic("/topic/test")
+	ch1 := make(chan frame.Frame, 4)
+	ch2 := make(chan frame.Frame, 4)
+	subscribeTopic(topic, "s1", ch1, nil)
+	subscribeTopic(topic, "s2", ch2, nil)
+	sendTopic(topic, "m1")
+	fr := expectBody(t, ch1, "m1")
+	id, _ := fr.Header.Get(frame.HdrSubscription)
+	assert.Equal(t, "s1", id)
+	fr = expectBody(t, ch2, "m1")
+	id, _ = fr.Header.Get(frame.HdrSubscription)
+	assert.Equal(t, "s2", id)
+	topic.Unsubscribe("s1")
+	sendTopic(topic, "m2")
+	expectNothing(t, ch1)
+	expectBody(t, ch2, "m2")
+}
+
+// publisher is not stalled by client, which don't read messages
+func TestTopicSlowConsumer(t *testing.T) {
+	cases := []struct {
+		policy SlowConsumerPolicy
+		expect []string
+	}{
+		{SlowConsumerDropNewest, []string{"m0", "m1", "m2"}},
+		{SlowConsumerDropOldest, []string{"m0", "m8", "m9"}},
+	}
+	for _, c := range cases {
+		topic := NewTopic("/topic/test")
+		topic.Limits = TopicLimits{BufferSize: 2, SlowConsumer: c.policy}
+		slow := make(chan frame.Frame)
+		subscribeTopic(topic, "slow", slow, nil)
+		sendTopic(topic, "m0")
+		// wait until writeLoop of subscription is blocked with m0
+		time.Sleep(time.Millisecond * 5)
+		for i := 1; i < 10; i++ {
+			sendTopic(topic, "m"+strconv.Itoa(i))
+		}
+		for _, body := range c.expect {
+			expectBody(t, slow, body)
+		}
+		expectNothing(t, slow)
+		assert.Equal(t, 7, topic.Dropped("slow"))
+		assert.Equal(t, 7, topic.TotalDropped())
+	}
+}
+
+func TestTopicSlowConsumerDisconnect(t *testing.T) {
+	topic := NewTopic("/topic/test")
+	topic.Limits = TopicLimits{BufferSize: 1, SlowConsumer: SlowConsumerDisconnect}
+	var wg sync.WaitGroup
+	wg.Add(1)
+	disconnected := 0
+	slow := make(chan frame.Frame)
+	subscribeTopic(topic, "slow", slow, func() {
+		disconnected++
+		topic.Unsubscribe("slow")
+		wg.Done()
+	})
+	for i := 0; i < 10; i++ {
+		sendTopic(topic, "m"+strconv.Itoa(i))
+	}
+	wg.Wait()
+	assert.Equal(t, 1, disconnected)
+	assert.Equal(t, 0, len(topic.Subscribers))
+}
+
+func subscribeDurable(topic *Topic, subscriptionId, clientId, name string) (chan frame.Frame, error) {
+	subscribeFrame := frame.New()
+	subscribeFrame.Command = frame.CmdSubscribe
+	subscribeFrame.Header.Set(frame.HdrId, subscriptionId)
+	subscribeFrame.Header.Set(frame.HdrSubscriptionName, name)
+	ch := make(chan frame.Frame, 16)
+	err := topic.Subscribe(*subscribeFrame, SubscriptionOptions{ClientWriteChan: ch, ClientId: clientId})
+	return ch, err
+}
+
+func TestTopicDurable(t *testing.T) {
+	topic := NewTopic("/topic/test")
+	_, err := subscribeDurable(topic, "s1", "", "sub")
+	assert.Equal(t, ErrMissingClientId, err)
+
+	ch, err := subscribeDurable(topic, "s1", "client", "sub")
+	assert.NoError(t, err)
+	_, err = subscribeDurable(topic, "s2", "client", "sub")
+	assert.Equal(t, ErrDurableSubActive, err)
+	sendTopic(topic, "m1")
+	expectBody(t, ch, "m1")
+
+	// messages are accumulated while client is offline
+	topic.Unsubscribe("s1")
+	sendTopic(topic, "m2")
+	sendTopic(topic, "m3")
+	expectNothing(t, ch)
+	ch, err = subscribeDurable(topic, "s2", "client", "sub")
+	assert.NoError(t, err)
+	fr := expectBody(t, ch, "m2")
+	id, _ := fr.Header.Get(frame.HdrSubscription)
+	assert.Equal(t, "s2", id)
+	expectBody(t, ch, "m3")
+
+	// other client has it's own subscription with the same name
+	other, err := subscribeDurable(topic, "s1", "other", "sub")
+	assert.NoError(t, err)
+	topic.Unsubscribe("s2")
+	assert.True(t, topic.RemoveDurable("client", "sub"))
+	assert.False(t, topic.RemoveDurable("client", "sub"))
+	sendTopic(topic, "m4")
+	expectBody(t, other, "m4")
+	ch, err = subscribeDurable(topic, "s2", "client", "sub")
+	assert.NoError(t, err)
+	expectNothing(t, ch)
+}
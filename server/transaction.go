@@ -0,0 +1,86 @@
+package server
+
+import (
+	"errors"
+	"github.com/galtsev/stomp/frame"
+)
+
+var (
+	ErrUnknownTransaction   = errors.New("Unknown transaction")
+	ErrDuplicateTransaction = errors.New("Transaction already started")
+	ErrMissingTransaction   = errors.New("Missing transaction header")
+)
+
+// SEND or ACK. Actions of transaction are prepared all, before any of them
+// is committed, so that they are done all or none
+type action struct {
+	// check, that action can be done, and reserve everything it needs
+	prepare func() error
+	// complete prepared action
+	commit func()
+	// undo prepare
+	rollback func()
+}
+
+// SENDs and ACKs of transaction, deferred until COMMIT
+type transaction struct {
+	actions []action
+}
+
+type transactions map[string]*transaction
+
+func (t transactions) begin(fr frame.Frame) error {
+	id, ok := fr.Header.Get(frame.HdrTransaction)
+	if !ok {
+		return ErrMissingTransaction
+	}
+	if _, ok := t[id]; ok {
+		return ErrDuplicateTransaction
+	}
+	t[id] = &transaction{}
+	return nil
+}
+
+// remove transaction and return it's actions
+func (t transactions) end(fr frame.Frame) ([]action, error) {
+	id, ok := fr.Header.Get(frame.HdrTransaction)
+	if !ok {
+		return nil, ErrMissingTransaction
+	}
+	tx, ok := t[id]
+	if !ok {
+		return nil, ErrUnknownTransaction
+	}
+	delete(t, id)
+	return tx.actions, nil
+}
+
+// run action immediately or, if frame is part of transaction, on commit
+func (t transactions) perform(fr frame.Frame, a action) error {
+	id, ok := fr.Header.Get(frame.HdrTransaction)
+	if !ok {
+		return commit([]action{a})
+	}
+	tx, ok := t[id]
+	if !ok {
+		return ErrUnknownTransaction
+	}
+	tx.actions = append(tx.actions, a)
+	return nil
+}
+
+// do all actions or, if one of them can't be prepared, none
+func commit(actions []action) error {
+	for i, a := range actions {
+		if err := a.prepare(); err != nil {
+			for _, prepared := range actions[:i] {
+				prepared.rollback()
+			}
+			return err
+		}
+	}
+	for _, a := range actions {
+		a.commit()
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package server
+
+import (
+	"sync"
+)
+
+// Topic destination is sequence of segments, separated by '.' or '/'.
+// In wildcard destination segment "*" match any single segment,
+// and the last segment ">" match one or more segments, as in
+//
+//	/topic/prices.*.EUR
+//	/topic/orders.>
+func isWildcard(destination string) bool {
+	for _, token := range tokenizeDestination(destination) {
+		if token == "*" || token == ">" {
+			return true
+		}
+	}
+	return false
+}
+
+func isSeparator(token string) bool {
+	return token == "." || token == "/"
+}
+
+// split destination to segments and separators between them
+func tokenizeDestination(destination string) []string {
+	var tokens []string
+	start := 0
+	for i := 0; i < len(destination); i++ {
+		if c := destination[i]; c == '.' || c == '/' {
+			if i > start {
+				tokens = append(tokens, destination[start:i])
+			}
+			tokens = append(tokens, destination[i:i+1])
+			start = i + 1
+		}
+	}
+	if start < len(destination) {
+		tokens = append(tokens, destination[start:])
+	}
+	return tokens
+}
+
+type topicNode struct {
+	children map[string]*topicNode
+	// topics, which pattern end at this node
+	topics []*Topic
+	// topics, which pattern end with ">" after this node
+	rest []*Topic
+}
+
+func newTopicNode() *topicNode {
+	return &topicNode{children: make(map[string]*topicNode)}
+}
+
+// topicIndex is trie of wildcard topics by tokens of their patterns
+type topicIndex struct {
+	root *topicNode
+	lock sync.RWMutex
+}
+
+func newTopicIndex() *topicIndex {
+	return &topicIndex{root: newTopicNode()}
+}
+
+func (idx *topicIndex) add(topic *Topic) {
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+	node := idx.root
+	tokens := tokenizeDestination(topic.Destination)
+	for i, token := range tokens {
+		if token == ">" && i == len(tokens)-1 {
+			node.rest = append(node.rest, topic)
+			return
+		}
+		child, ok := node.children[token]
+		if !ok {
+			child = newTopicNode()
+			node.children[token] = child
+		}
+		node = child
+	}
+	node.topics = append(node.topics, topic)
+}
+
+// wildcard topics, which pattern match destination
+func (idx *topicIndex) match(destination string) []*Topic {
+	idx.lock.RLock()
+	defer idx.lock.RUnlock()
+	return idx.root.match(tokenizeDestination(destination), nil)
+}
+
+func (node *topicNode) match(tokens []string, found []*Topic) []*Topic {
+	if len(tokens) == 0 {
+		return append(found, node.topics...)
+	}
+	found = append(found, node.rest...)
+	if child, ok := node.children[tokens[0]]; ok {
+		found = child.match(tokens[1:], found)
+	}
+	if !isSeparator(tokens[0]) {
+		if child, ok := node.children["*"]; ok && tokens[0] != "*" {
+			found = child.match(tokens[1:], found)
+		}
+	}
+	return found
+}
@@ -0,0 +1,86 @@
+package server
+
+import (
+	"github.com/galtsev/stomp/frame"
+	"github.com/stretchr/testify/assert"
+	"sort"
+	"testing"
+)
+
+func TestTopicIndex(t *testing.T) {
+	idx := newTopicIndex()
+	for _, pattern := range []string{
+		"/topic/prices.*.EUR",
+		"/topic/prices.>",
+		"/topic/*/news",
+		"/topic/>",
+		"/topic/orders.new",
+	} {
+		idx.add(NewTopic(pattern))
+	}
+	cases := []struct {
+		destination string
+		patterns    []string
+	}{
+		{"/topic/prices.AAPL.EUR", []string{"/topic/prices.*.EUR", "/topic/prices.>", "/topic/>"}},
+		{"/topic/prices.AAPL.USD", []string{"/topic/prices.>", "/topic/>"}},
+		{"/topic/prices.AAPL/EUR", []string{"/topic/prices.>", "/topic/>"}},
+		{"/topic/prices", []string{"/topic/>"}},
+		{"/topic/sport/news", []string{"/topic/*/news", "/topic/>"}},
+		{"/topic/orders.new", []string{"/topic/orders.new", "/topic/>"}},
+		{"/queue/prices.AAPL.EUR", nil},
+	}
+	for _, c := range cases {
+		var patterns []string
+		for _, topic := range idx.match(c.destination) {
+			patterns = append(patterns, topic.Destination)
+		}
+		sort.Strings(patterns)
+		sort.Strings(c.patterns)
+		assert.Equal(t, c.patterns, patterns, c.destination)
+	}
+	assert.True(t, isWildcard("/topic/prices.*.EUR"))
+	assert.True(t, isWildcard("/topic/>"))
+	assert.False(t, isWildcard("/topic/prices*"))
+}
+
+func TestWildcardSubscription(t *testing.T) {
+	server := NewServer()
+	eur := make(chan frame.Frame, 4)
+	all := make(chan frame.Frame, 4)
+	subscribeTopic(server.GetDispatcher("/topic/prices.*.EUR").(*Topic), "s1", eur, nil)
+	subscribeTopic(server.GetDispatcher("/topic/prices.>").(*Topic), "s2", all, nil)
+
+	sendTopic(server.GetDispatcher("/topic/prices.AAPL.EUR").(*Topic), "p1")
+	sendTopic(server.GetDispatcher("/topic/prices.AAPL.USD").(*Topic), "p2")
+	fr := expectBody(t, eur, "p1")
+	destination, _ := fr.Header.Get(frame.HdrDestination)
+	assert.Equal(t, "/topic/prices.AAPL.EUR", destination)
+	id, _ := fr.Header.Get(frame.HdrSubscription)
+	assert.Equal(t, "s1", id)
+	expectNothing(t, eur)
+	expectBody(t, all, "p1")
+	expectBody(t, all, "p2")
+	expectNothing(t, all)
+}
+
+func TestHandlerSendWildcard(t *testing.T) {
+	server := NewServer()
+	handler := NewHandler(server, nil, nil)
+	go handler.Handle(*makeSendFrame("/topic/prices.*", "p1"))
+	fr := <-handler.outChan
+	assert.Equal(t, frame.CmdError, fr.Command)
+}
+
+// wildcard subscription is allowed only if ACL cover all it's destinations
+func TestHandlerSubscribeWildcardACL(t *testing.T) {
+	server := NewServer()
+	server.Authorizer = &RuleAuthorizer{Rules: []Rule{
+		{Pattern: "/topic/*", Users: []string{"*"}, Permissions: PermRead},
+	}}
+	handler := NewHandler(server, nil, nil)
+	handler.Handle(*makeSubscriptionFrame("s1", "/topic/*"))
+	go handler.Handle(*makeSubscriptionFrame("s2", "/topic/>"))
+	fr := <-handler.outChan
+	assert.Equal(t, frame.CmdError, fr.Command)
+}
@@ -1,10 +1,46 @@
 package main
 
 import (
+	"flag"
 	"github.com/galtsev/stomp/server"
+	"log"
+	"net/http"
 )
 
 func main() {
+	users := flag.String("users", "", "file with login:bcrypt-hash lines, enable authentication")
+	acl := flag.String("acl", "", "file with destination access rules")
+	store := flag.String("store", "", "directory for persistent messages")
+	expiryQueue := flag.String("expiry-queue", "", "queue for expired messages, they are dropped if empty")
+	admin := flag.String("admin", "", "address of HTTP admin interface, disabled if empty")
+	flag.Parse()
 	srv := server.NewServer()
+	srv.ExpiryQueue = *expiryQueue
+	if *users != "" {
+		auth, err := server.NewFileAuthenticator(*users)
+		if err != nil {
+			log.Fatal(err)
+		}
+		srv.Authenticator = auth
+	}
+	if *acl != "" {
+		auth, err := server.NewFileAuthorizer(*acl)
+		if err != nil {
+			log.Fatal(err)
+		}
+		srv.Authorizer = auth
+	}
+	if *store != "" {
+		fileStore, err := server.NewFileStore(*store, server.DefaultFileStoreOptions)
+		if err != nil {
+			log.Fatal(err)
+		}
+		srv.Store = fileStore
+	}
+	if *admin != "" {
+		go func() {
+			log.Fatal(http.ListenAndServe(*admin, server.NewAdminHandler(srv)))
+		}()
+	}
 	srv.ListenAndServe("localhost:1620")
 }